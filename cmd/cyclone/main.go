@@ -45,15 +45,21 @@ func init() {
 
 func main() {
 	var (
-		err         error
-		configFlag  string
-		logFH       *reopen.FileWriter
-		versionFlag bool
+		err             error
+		configFlag      string
+		logFH           *reopen.FileWriter
+		versionFlag     bool
+		skipPrewarmFlag bool
+		validateFlag    bool
 	)
 	flag.StringVar(&configFlag, `config`, `cyclone.conf`,
 		`Configuration file location`)
 	flag.BoolVar(&versionFlag, `version`, false,
 		`Print version information`)
+	flag.BoolVar(&skipPrewarmFlag, `skip-prewarm`, false,
+		`Skip loading all thresholds before consuming`)
+	flag.BoolVar(&validateFlag, `validate`, false,
+		`Validate the configuration and exit`)
 	flag.Parse()
 
 	// only provide version information if --version was specified
@@ -67,11 +73,24 @@ func main() {
 	}
 
 	// read runtime configuration
-	conf := erebos.Config{}
+	conf := cyclone.Config{}
 	if err = conf.FromFile(configFlag); err != nil {
 		logrus.Fatalf("Could not open configuration: %s", err)
 	}
 
+	// only validate the configuration if --validate was specified
+	if validateFlag {
+		errs := validate(&conf)
+		for _, vErr := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", configFlag, vErr)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "%s: configuration is valid\n", configFlag)
+		os.Exit(0)
+	}
+
 	// setup logfile
 	if logFH, err = reopen.NewFileWriter(
 		filepath.Join(conf.Log.Path, conf.Log.File),
@@ -94,13 +113,17 @@ func main() {
 	if conf.Log.Rotate {
 		sigChanLogRotate := make(chan os.Signal, 1)
 		signal.Notify(sigChanLogRotate, syscall.SIGUSR2)
-		go erebos.Logrotate(sigChanLogRotate, conf)
+		go erebos.Logrotate(sigChanLogRotate, conf.Config)
 	}
 
 	// setup signal receiver for graceful shutdown
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
+	// setup signal receiver for configuration reloads
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
 	// this channel is used by the handlers on error
 	handlerDeath := make(chan error)
 	// this channel is used to signal the consumer to stop
@@ -125,13 +148,53 @@ func main() {
 		pfxRegistry)
 	metrics.NewRegisteredMeter(`/metrics/processed.per.second`,
 		pfxRegistry)
+	metrics.NewRegisteredMeter(`/metrics/rejected.per.second`,
+		pfxRegistry)
+	metrics.NewRegisteredCounter(`/metrics/panics`,
+		pfxRegistry)
+	metrics.NewRegisteredCounter(`/handlers/restarts`,
+		pfxRegistry)
 	metrics.NewRegisteredMeter(`/evaluations.per.second`,
 		pfxRegistry)
 	metrics.NewRegisteredMeter(`/alarms.per.second`,
 		pfxRegistry)
+	metrics.NewRegisteredMeter(`/alarms/suppressed.per.second`,
+		pfxRegistry)
+	metrics.NewRegisteredMeter(`/alarms/delivered.per.second`,
+		pfxRegistry)
+	metrics.NewRegisteredMeter(`/alarms/retries.per.second`,
+		pfxRegistry)
+	metrics.NewRegisteredMeter(`/alarms/deadletter.per.second`,
+		pfxRegistry)
+	metrics.NewRegisteredMeter(`/alarms/filtered.per.second`,
+		pfxRegistry)
+	metrics.NewRegisteredGauge(`/alarms/outbox.depth`,
+		pfxRegistry)
+	metrics.NewRegisteredGauge(`/alarms/deadletter.depth`,
+		pfxRegistry)
+	metrics.NewRegisteredMeter(`/lookup/coalesced.per.second`,
+		pfxRegistry)
+	metrics.NewRegisteredMeter(`/lookup/revalidations.per.second`,
+		pfxRegistry)
+	metrics.NewRegisteredTimer(`/lookup/duration`,
+		pfxRegistry)
+	metrics.NewRegisteredTimer(`/redis/duration`,
+		pfxRegistry)
+	metrics.NewRegisteredTimer(`/evaluation/duration`,
+		pfxRegistry)
+	metrics.NewRegisteredTimer(`/alarms/delivery.duration`,
+		pfxRegistry)
+	metrics.NewRegisteredHistogram(`/metrics/age.at.dispatch.ms`,
+		pfxRegistry, cyclone.NewAgeSample())
+	metrics.NewRegisteredHistogram(`/metrics/age.at.evaluation.ms`,
+		pfxRegistry, cyclone.NewAgeSample())
+	metrics.NewRegisteredMeter(`/state/evicted.assets.per.second`,
+		pfxRegistry)
+	metrics.NewRegisteredMeter(`/state/evicted.mountpoints.per.second`,
+		pfxRegistry)
 
 	// start metric socket
-	ms := legacy.NewMetricSocket(&conf, &pfxRegistry, handlerDeath,
+	ms := legacy.NewMetricSocket(&conf.Config, &pfxRegistry, handlerDeath,
 		cyclone.FormatMetrics)
 	if conf.Misc.ProduceMetrics {
 		logrus.Info(`Launched metrics producer socket`)
@@ -142,9 +205,44 @@ func main() {
 		}()
 	}
 
-	cyclone.AgeCutOff = time.Duration(
-		conf.Cyclone.MetricsMaxAge,
-	) * time.Minute * -1
+	cyclone.ApplySettings(cyclone.NewSettings(&conf))
+	cyclone.StateTTL = time.Duration(
+		conf.Cyclone.StateTTL,
+	) * time.Minute
+
+	// the in-process threshold cache is shared by all handlers
+	cache := cyclone.NewThresholdCache(
+		&conf,
+		&pfxRegistry,
+	)
+
+	// start threshold provider
+	provider, err := cyclone.NewThresholdProvider(&conf, cache)
+	if err != nil {
+		logrus.Fatalf("Could not setup lookup provider: %s", err)
+	}
+	waitdelay.Use()
+	go func() {
+		defer waitdelay.Done()
+		provider.Run()
+	}()
+
+	// start alarm outbox
+	outbox := cyclone.NewOutbox(&conf, &pfxRegistry, handlerDeath)
+	waitdelay.Use()
+	go func() {
+		defer waitdelay.Done()
+		outbox.Run()
+	}()
+	logrus.Info(`Launched alarm outbox`)
+
+	// the lookup service circuit breaker is shared by all handlers
+	lookupBreaker := cyclone.NewBreaker(
+		`lookup`,
+		conf.Cyclone.CircuitThreshold,
+		time.Duration(conf.Cyclone.CircuitCooldown)*time.Second,
+		&pfxRegistry,
+	)
 
 	// start application handlers
 	for i := 0; i < runtime.NumCPU(); i++ {
@@ -152,12 +250,21 @@ func main() {
 			Num: i,
 			Input: make(chan *erebos.Transport,
 				conf.Cyclone.HandlerQueueLength),
-			Shutdown: make(chan struct{}),
-			Death:    handlerDeath,
-			Config:   &conf,
-			Metrics:  &pfxRegistry,
+			Shutdown:      make(chan struct{}),
+			Death:         handlerDeath,
+			Config:        &conf,
+			Metrics:       &pfxRegistry,
+			Outbox:        outbox,
+			LookupBreaker: lookupBreaker,
+			Cache:         cache,
+			Provider:      provider,
 		}
 		cyclone.Handlers[i] = &h
+		metrics.NewRegisteredFunctionalGauge(
+			fmt.Sprintf("/handler/%d/queue.depth", i),
+			pfxRegistry,
+			func() int64 { return int64(len(h.Input)) },
+		)
 		waitdelay.Use()
 		go func() {
 			defer waitdelay.Done()
@@ -166,20 +273,55 @@ func main() {
 		logrus.Infof("Launched Cyclone handler #%d", i)
 	}
 
+	// start admin API
+	admin := cyclone.NewAdmin(&conf, &pfxRegistry, cache, provider,
+		handlerDeath)
+	admin.Version = cyclone.BuildInfo{
+		Githash:   githash,
+		Shorthash: shorthash,
+		Builddate: builddate,
+		Buildtime: buildtime,
+	}
+	if conf.Cyclone.AdminListen != `` {
+		waitdelay.Use()
+		go func() {
+			defer waitdelay.Done()
+			admin.Run()
+		}()
+		logrus.Infof("Launched admin API on %s", conf.Cyclone.AdminListen)
+	}
+
+	// load all thresholds before the consumer starts
+	if !skipPrewarmFlag {
+		if err = cyclone.Prewarm(&conf, cache, provider); err != nil {
+			logrus.Warnf("Threshold prewarming failed: %s", err)
+		}
+	}
+
 	// start kafka consumer
 	waitdelay.Use()
 	go func() {
 		defer waitdelay.Done()
+		// the consumer is marked running while it is registered in
+		// its consumer group
+		stopWatch := make(chan struct{})
+		watchDone := make(chan struct{})
+		go func() {
+			cyclone.WatchConsumer(&conf, stopWatch)
+			close(watchDone)
+		}()
 		erebos.Consumer(
-			&conf,
+			&conf.Config,
 			wrappedDispatch(&pfxRegistry, cyclone.Dispatch),
 			consumerShutdown,
 			consumerExit,
 			handlerDeath,
 		)
+		close(stopWatch)
+		<-watchDone
 	}()
 
-	heartbeat := time.Tick(5 * time.Second)
+	heartbeat := time.Tick(cyclone.HeartbeatInterval)
 	beatcount := 0
 
 	// the main loop
@@ -192,6 +334,9 @@ runloop:
 		case <-c:
 			logrus.Infoln(`Received shutdown signal`)
 			break runloop
+		case <-hup:
+			logrus.Infoln(`Received reload signal`)
+			reload(configFlag, &conf, outbox)
 		case err := <-handlerDeath:
 			logrus.Errorf("Handler died: %s", err.Error())
 			fault = true
@@ -207,6 +352,9 @@ runloop:
 
 	// close all handlers
 	close(ms.Shutdown)
+	close(outbox.Shutdown)
+	close(admin.Shutdown)
+	close(provider.ShutdownChannel())
 	close(consumerShutdown)
 
 	// not safe to close InputChannel before consumer is gone
@@ -0,0 +1,108 @@
+/*-
+ * Copyright © 2017 Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package main // import "github.com/mjolnir42/cyclone/cmd/cyclone"
+
+import (
+	"reflect"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mjolnir42/cyclone/lib/cyclone"
+)
+
+// reload re-reads the configuration file at path and applies the
+// reloadable settings: metrics.max.age.minutes, the log level,
+// alarming.destination and testmode. Changes to all other settings
+// are rejected with a log entry. conf is updated with the applied
+// values.
+func reload(path string, conf *cyclone.Config, outbox *cyclone.Outbox) {
+	next := cyclone.Config{}
+	if err := next.FromFile(path); err != nil {
+		logrus.Errorf("Reload, ERROR reading configuration: %s", err)
+		return
+	}
+	if errs := validate(&next); len(errs) > 0 {
+		for _, err := range errs {
+			logrus.Errorf("Reload, ERROR invalid configuration: %s", err)
+		}
+		return
+	}
+
+	for _, name := range changedSettings(conf, &next) {
+		logrus.Errorf("Reload, Rejected change of %s, which requires a restart", name)
+	}
+
+	if next.Cyclone.DestinationURI != conf.Cyclone.DestinationURI {
+		if conf.Cyclone.DestinationURI == `` ||
+			next.Cyclone.DestinationURI == `` {
+			logrus.Errorf("Reload, Rejected change of alarming.destination, adding or removing it requires a restart")
+		} else if err := outbox.SetDestination(
+			next.Cyclone.DestinationURI); err != nil {
+			logrus.Errorf("Reload, ERROR changing alarm destination: %s", err)
+		} else {
+			conf.Cyclone.DestinationURI = next.Cyclone.DestinationURI
+		}
+	}
+
+	cyclone.ApplySettings(cyclone.NewSettings(&next))
+	conf.Cyclone.MetricsMaxAge = next.Cyclone.MetricsMaxAge
+	conf.Cyclone.TestMode = next.Cyclone.TestMode
+
+	if next.Log.Debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	} else {
+		logrus.SetLevel(logrus.WarnLevel)
+	}
+	conf.Log.Debug = next.Log.Debug
+	logrus.Warnln(`Reloaded configuration`)
+}
+
+// changedSettings returns the names of the settings that differ
+// between conf and next, ignoring the reloadable settings
+func changedSettings(conf, next *cyclone.Config) []string {
+	cmp := *next
+	cmp.Cyclone.MetricsMaxAge = conf.Cyclone.MetricsMaxAge
+	cmp.Cyclone.TestMode = conf.Cyclone.TestMode
+	cmp.Cyclone.DestinationURI = conf.Cyclone.DestinationURI
+	cmp.Log.Debug = conf.Log.Debug
+	// the logfile handle is opened by main
+	cmp.Log.FH = conf.Log.FH
+	// the cyclone section of erebos is replaced by cmp.Cyclone
+	cmp.Config.Cyclone = conf.Config.Cyclone
+
+	changed := changedFields(``, reflect.ValueOf(conf.Config),
+		reflect.ValueOf(cmp.Config))
+	return append(changed, changedFields(`Cyclone.`,
+		reflect.ValueOf(conf.Cyclone), reflect.ValueOf(cmp.Cyclone))...)
+}
+
+// changedFields returns the names of the exported fields that differ
+// between the structs a and b. Fields that are structs themselves are
+// compared field by field.
+func changedFields(prefix string, a, b reflect.Value) []string {
+	changed := []string{}
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		if field.PkgPath != `` {
+			// unexported
+			continue
+		}
+		if a.Field(i).Kind() == reflect.Struct {
+			changed = append(changed, changedFields(
+				prefix+field.Name+`.`, a.Field(i), b.Field(i))...)
+			continue
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(),
+			b.Field(i).Interface()) {
+			changed = append(changed, prefix+field.Name)
+		}
+	}
+	return changed
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
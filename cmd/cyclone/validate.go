@@ -0,0 +1,217 @@
+/*-
+ * Copyright © 2017 Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package main // import "github.com/mjolnir42/cyclone/cmd/cyclone"
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/mjolnir42/cyclone/lib/cyclone"
+)
+
+// validate checks conf for missing required settings, malformed URLs,
+// values out of range and unreachable files and directories. It
+// returns all problems found.
+func validate(conf *cyclone.Config) []error {
+	v := &validator{}
+
+	// required settings
+	v.require(`zookeeper.connect`, conf.Zookeeper.Connect)
+	v.require(`kafka.consumer.group.name`, conf.Kafka.ConsumerGroup)
+	v.require(`kafka.consumer.topics`, conf.Kafka.ConsumerTopics)
+	v.require(`log.path`, conf.Log.Path)
+	v.require(`log.file`, conf.Log.File)
+	if !conf.Cyclone.TestMode && conf.Cyclone.DestinationURI == `` &&
+		len(conf.Cyclone.AlarmSinks) == 0 {
+		v.fail("alarming.destination or alarming.sinks is required unless testmode is enabled")
+	}
+
+	// ranges
+	v.atLeast(`metrics.max.age.minutes`, conf.Cyclone.MetricsMaxAge, 1)
+	v.atLeast(`handler.queue.length`, conf.Cyclone.HandlerQueueLength, 1)
+	for _, s := range []struct {
+		name string
+		val  int
+	}{
+		{`state.ttl.minutes`, conf.Cyclone.StateTTL},
+		{`alarming.backoff.initial.ms`, conf.Cyclone.AlarmBackoffInitial},
+		{`alarming.backoff.max.ms`, conf.Cyclone.AlarmBackoffMax},
+		{`alarming.max.age.minutes`, conf.Cyclone.AlarmMaxAge},
+		{`alarming.batch.size`, conf.Cyclone.AlarmBatchSize},
+		{`alarming.batch.wait.ms`, conf.Cyclone.AlarmBatchWait},
+		{`alarming.concurrency`, conf.Cyclone.AlarmConcurrency},
+		{`alarming.timeout.ms`, conf.Cyclone.AlarmTimeout},
+		{`lookup.timeout.ms`, conf.Cyclone.LookupTimeout},
+		{`lookup.retries`, conf.Cyclone.LookupRetries},
+		{`lookup.retry.wait.ms`, conf.Cyclone.LookupRetryWait},
+		{`lookup.prewarm.timeout.seconds`, conf.Cyclone.PrewarmTimeout},
+		{`circuit.failure.threshold`, conf.Cyclone.CircuitThreshold},
+		{`circuit.cooldown.seconds`, conf.Cyclone.CircuitCooldown},
+		{`cache.size`, conf.Cyclone.CacheSize},
+		{`cache.soft.ttl.seconds`, conf.Cyclone.CacheSoftTTL},
+		{`cache.hard.ttl.seconds`, conf.Cyclone.CacheHardTTL},
+	} {
+		v.atLeast(s.name, s.val, 0)
+	}
+	if conf.Cyclone.CacheSoftTTL > 0 && conf.Cyclone.CacheHardTTL > 0 &&
+		conf.Cyclone.CacheHardTTL < conf.Cyclone.CacheSoftTTL {
+		v.fail("cache.hard.ttl.seconds must not be lower than cache.soft.ttl.seconds")
+	}
+	if conf.Redis.DB < 0 {
+		v.fail("redis.db must not be negative")
+	}
+
+	// addresses
+	v.url(`alarming.destination`, conf.Cyclone.DestinationURI)
+	if conf.Cyclone.DestinationURI != `` {
+		v.credentials(`alarming`, conf.Cyclone.DefaultSink())
+	}
+	if conf.Cyclone.AdminListen != `` {
+		if _, _, err := net.SplitHostPort(conf.Cyclone.AdminListen); err != nil {
+			v.fail("admin.listen is not a valid address: %s", err)
+		}
+	}
+	if conf.Cyclone.InsecureAdmin() {
+		v.fail("admin.token is required if admin.listen is not a loopback address")
+	}
+	switch conf.Cyclone.LookupProvider {
+	case ``, `eye`:
+		if conf.Cyclone.LookupURL != `` {
+			v.url(`lookup.url`, conf.Cyclone.LookupURL)
+		} else {
+			v.require(`lookup.url or lookup.host`, conf.Cyclone.LookupHost)
+			v.require(`lookup.url or lookup.port`, conf.Cyclone.LookupPort)
+		}
+		if conf.Cyclone.InsecureLookup() {
+			v.fail("lookup.auth requires an https lookup.url")
+		}
+	case `file`:
+		v.require(`lookup.file`, conf.Cyclone.LookupFile)
+		v.file(`lookup.file`, conf.Cyclone.LookupFile)
+	default:
+		v.fail("lookup.provider must be eye or file, not %s",
+			conf.Cyclone.LookupProvider)
+	}
+	for _, s := range conf.Cyclone.AlarmSinks {
+		name := fmt.Sprintf("alarming.sinks[%s]", s.Name)
+		v.require(name+`.name`, s.Name)
+		switch s.Type {
+		case `http`:
+			v.require(name+`.uri`, s.URI)
+			v.url(name+`.uri`, s.URI)
+			v.credentials(name, s)
+			v.file(name+`.tls.ca.file`, s.TLSCAFile)
+			v.file(name+`.tls.cert.file`, s.TLSCertFile)
+			v.file(name+`.tls.key.file`, s.TLSKeyFile)
+		case `file`:
+			v.require(name+`.path`, s.Path)
+			if s.Path != `` {
+				v.dir(name+`.path`, filepath.Dir(s.Path))
+			}
+		case `kafka`:
+			v.require(name+`.topic`, s.Topic)
+		}
+	}
+	// build the alarm templates, sinks and routes like the handlers do
+	// to catch template errors, unknown sink types, duplicate sink
+	// names, invalid levels and routes to unknown sinks
+	for _, err := range cyclone.CheckAlarming(conf) {
+		v.fail("%s", err)
+	}
+
+	// files and directories
+	v.dir(`log.path`, conf.Log.Path)
+	v.file(`alarming.tls.ca.file`, conf.Cyclone.AlarmTLSCAFile)
+	v.file(`alarming.tls.cert.file`, conf.Cyclone.AlarmTLSCertFile)
+	v.file(`alarming.tls.key.file`, conf.Cyclone.AlarmTLSKeyFile)
+	v.file(`lookup.tls.ca.file`, conf.Cyclone.LookupTLSCAFile)
+	v.file(`lookup.tls.cert.file`, conf.Cyclone.LookupTLSCertFile)
+	v.file(`lookup.tls.key.file`, conf.Cyclone.LookupTLSKeyFile)
+
+	return v.errs
+}
+
+// validator collects the problems found by validate
+type validator struct {
+	errs []error
+}
+
+// fail records a problem
+func (v *validator) fail(format string, args ...interface{}) {
+	v.errs = append(v.errs, fmt.Errorf(format, args...))
+}
+
+// require checks that the setting name has a value
+func (v *validator) require(name, val string) {
+	if val == `` {
+		v.fail("%s is required", name)
+	}
+}
+
+// atLeast checks that the setting name is not lower than min
+func (v *validator) atLeast(name string, val, min int) {
+	if val < min {
+		v.fail("%s must be at least %d, not %d", name, min, val)
+	}
+}
+
+// url checks that the setting name is empty or an HTTP URL
+func (v *validator) url(name, val string) {
+	if val == `` {
+		return
+	}
+	u, err := url.Parse(val)
+	if err != nil || (u.Scheme != `http` && u.Scheme != `https`) ||
+		u.Host == `` {
+		v.fail("%s is not an HTTP URL: %s", name, val)
+	}
+}
+
+// credentials checks that the sink s configured by the settings name
+// does not send credentials without TLS
+func (v *validator) credentials(name string, s cyclone.SinkConfig) {
+	if s.InsecureAuth() {
+		v.fail("%s.auth requires an https URI, not %s", name, s.URI)
+	}
+}
+
+// file checks that the setting name is empty or a readable file
+func (v *validator) file(name, path string) {
+	if path == `` {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		v.fail("%s is not readable: %s", name, err)
+		return
+	}
+	defer f.Close()
+	if stat, err := f.Stat(); err != nil || stat.IsDir() {
+		v.fail("%s is not a file: %s", name, path)
+	}
+}
+
+// dir checks that the setting name is empty or an existing directory
+func (v *validator) dir(name, path string) {
+	if path == `` {
+		return
+	}
+	stat, err := os.Stat(path)
+	switch {
+	case err != nil:
+		v.fail("%s is not accessible: %s", name, err)
+	case !stat.IsDir():
+		v.fail("%s is not a directory: %s", name, path)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
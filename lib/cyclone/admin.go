@@ -0,0 +1,293 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/go-redis/redis"
+	"github.com/julienschmidt/httprouter"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Admin is the embedded HTTP server for the administrative API
+type Admin struct {
+	Shutdown chan struct{}
+	Version  BuildInfo
+	death    chan error
+	conf     *Config
+	metrics  *metrics.Registry
+	redis    *redis.Client
+	cache    *ThresholdCache
+	provider ThresholdProvider
+	server   *http.Server
+}
+
+// NewAdmin returns a new Admin for configuration conf that exports reg,
+// manages the threshold cache and checks the reachability of provider
+func NewAdmin(conf *Config, reg *metrics.Registry, cache *ThresholdCache, provider ThresholdProvider, death chan error) *Admin {
+	return &Admin{
+		Shutdown: make(chan struct{}),
+		death:    death,
+		conf:     conf,
+		metrics:  reg,
+		cache:    cache,
+		provider: provider,
+	}
+}
+
+// Run starts the HTTP server and blocks until the Admin is shut down.
+// Without admin.token, the admin API may only listen on a loopback
+// address.
+func (a *Admin) Run() {
+	if a.conf.Cyclone.InsecureAdmin() {
+		a.death <- fmt.Errorf("Admin API on %s requires admin.token, it does not listen on a loopback address",
+			a.conf.Cyclone.AdminListen)
+		<-a.Shutdown
+		return
+	}
+	if a.conf.Redis.Connect != `` {
+		a.redis = redis.NewClient(&redis.Options{
+			Addr:     a.conf.Redis.Connect,
+			Password: a.conf.Redis.Password,
+			DB:       int(a.conf.Redis.DB),
+		})
+		if _, err := a.redis.Ping().Result(); err != nil {
+			a.death <- err
+			<-a.Shutdown
+			return
+		}
+		defer a.redis.Close()
+	}
+
+	router := httprouter.New()
+	router.GET(`/api/silences`, a.requireRedis(a.listSilences))
+	router.POST(`/api/silences`, a.requireToken(a.requireRedis(a.createSilence)))
+	router.DELETE(`/api/silences/:id`, a.requireToken(a.requireRedis(a.expireSilence)))
+	router.POST(`/api/invalidate`, a.requireToken(a.invalidate))
+	router.GET(`/api/version`, a.version)
+	router.GET(`/api/handlers`, a.listHandlers)
+	router.GET(`/api/thresholds/:lookup`, a.showThresholds)
+	router.GET(`/api/assets/:id`, a.showAsset)
+	router.GET(`/api/alarms`, a.listAlarms)
+	router.GET(`/healthz`, a.healthz)
+	router.GET(`/readyz`, a.readyz)
+	router.GET(`/metrics`, a.prometheus)
+
+	a.server = &http.Server{
+		Addr:    a.conf.Cyclone.AdminListen,
+		Handler: router,
+	}
+	go func() {
+		if err := a.server.ListenAndServe(); err != http.ErrServerClosed {
+			a.death <- err
+		}
+	}()
+
+	<-a.Shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	a.server.Shutdown(ctx)
+}
+
+// requireToken wraps h to reject requests without the bearer token
+// configured as admin.token. Without admin.token all requests are
+// accepted.
+func (a *Admin) requireToken(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request,
+		params httprouter.Params) {
+		token := a.conf.Cyclone.AdminToken
+		if token != `` && subtle.ConstantTimeCompare(
+			[]byte(r.Header.Get(`Authorization`)),
+			[]byte(`Bearer `+token)) != 1 {
+			w.Header().Set(`WWW-Authenticate`, `Bearer realm="cyclone"`)
+			http.Error(w, `Unauthorized`, http.StatusUnauthorized)
+			return
+		}
+		h(w, r, params)
+	}
+}
+
+// requireRedis wraps h to fail requests if redis is not configured
+func (a *Admin) requireRedis(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request,
+		params httprouter.Params) {
+		if a.redis == nil {
+			http.Error(w, `Not available without redis`,
+				http.StatusServiceUnavailable)
+			return
+		}
+		h(w, r, params)
+	}
+}
+
+// listSilences returns all silences
+func (a *Admin) listSilences(w http.ResponseWriter, r *http.Request,
+	_ httprouter.Params) {
+	silences, err := listSilences(a.redis)
+	if err != nil {
+		a.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	a.writeJSON(w, http.StatusOK, silences)
+}
+
+// createSilence stores the silence from the request body
+func (a *Admin) createSilence(w http.ResponseWriter, r *http.Request,
+	_ httprouter.Params) {
+	s := Silence{}
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		a.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.ID = newID()
+	if s.StartsAt.IsZero() {
+		s.StartsAt = time.Now().UTC()
+	}
+	if err := s.Validate(); err != nil {
+		a.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := storeSilence(a.redis, &s); err != nil {
+		a.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	logrus.Infof("Admin, Created silence %s until %s", s.ID,
+		s.EndsAt.Format(time.RFC3339))
+	a.writeJSON(w, http.StatusCreated, s)
+}
+
+// expireSilence ends a silence immediately
+func (a *Admin) expireSilence(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	s, err := expireSilence(a.redis, params.ByName(`id`))
+	switch {
+	case err == redis.Nil:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case err != nil:
+		a.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	logrus.Infof("Admin, Expired silence %s", s.ID)
+	a.writeJSON(w, http.StatusOK, s)
+}
+
+// invalidate drops the cached thresholds named in the request body
+func (a *Admin) invalidate(w http.ResponseWriter, r *http.Request,
+	_ httprouter.Params) {
+	i := Invalidation{}
+	if err := json.NewDecoder(r.Body).Decode(&i); err != nil {
+		a.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := i.Validate(); err != nil {
+		a.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	lookups, err := invalidate(a.redis, a.cache, &i)
+	if err != nil {
+		a.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	logrus.Infof("Admin, Invalidated thresholds for %v", lookups)
+	a.writeJSON(w, http.StatusOK, map[string][]string{
+		`lookup_ids`: lookups,
+	})
+}
+
+// version returns the build information
+func (a *Admin) version(w http.ResponseWriter, r *http.Request,
+	_ httprouter.Params) {
+	a.writeJSON(w, http.StatusOK, a.Version)
+}
+
+// listHandlers returns the status of all handlers
+func (a *Admin) listHandlers(w http.ResponseWriter, r *http.Request,
+	_ httprouter.Params) {
+	res := []HandlerStatus{}
+	for _, c := range cyclones() {
+		res = append(res, c.status())
+	}
+	a.writeJSON(w, http.StatusOK, res)
+}
+
+// showThresholds returns the cached thresholds for a LookupID
+func (a *Admin) showThresholds(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	lookup := params.ByName(`lookup`)
+	thr, stored, ok := a.cache.Peek(lookup)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	a.writeJSON(w, http.StatusOK, struct {
+		LookupID   string            `json:"lookup_id"`
+		Stored     time.Time         `json:"stored"`
+		Thresholds map[string]Thresh `json:"thresholds"`
+	}{
+		LookupID:   lookup,
+		Stored:     stored,
+		Thresholds: thr,
+	})
+}
+
+// showAsset returns the derived metric state for an asset
+func (a *Admin) showAsset(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+	id, err := strconv.ParseInt(params.ByName(`id`), 10, 64)
+	if err != nil {
+		a.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	for _, c := range cyclones() {
+		if s := c.assetState(id); s != nil {
+			a.writeJSON(w, http.StatusOK, s)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// listAlarms returns the alarms currently firing on all handlers
+func (a *Admin) listAlarms(w http.ResponseWriter, r *http.Request,
+	_ httprouter.Params) {
+	res := []FiringAlarm{}
+	for _, c := range cyclones() {
+		res = append(res, c.firingAlarms()...)
+	}
+	a.writeJSON(w, http.StatusOK, res)
+}
+
+// writeJSON sends v as JSON encoded response with status code
+func (a *Admin) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		a.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set(`Content-Type`, `application/json`)
+	w.WriteHeader(code)
+	w.Write(buf)
+}
+
+// writeError sends err as response with status code
+func (a *Admin) writeError(w http.ResponseWriter, code int, err error) {
+	logrus.Errorf("Admin, ERROR serving request: %s", err)
+	http.Error(w, err.Error(), code)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,147 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// States of a Breaker as exported via its state gauge
+const (
+	CircuitClosed   = 0
+	CircuitHalfOpen = 1
+	CircuitOpen     = 2
+)
+
+// Breaker is a circuit breaker for calls to an external service. After
+// threshold consecutive failures the circuit opens and all calls are
+// rejected until cooldown has passed. Then a single probe call is
+// allowed, whose result closes or reopens the circuit. A nil Breaker
+// allows all calls.
+type Breaker struct {
+	name      string
+	lock      sync.Mutex
+	state     int64
+	failures  int
+	threshold int
+	cooldown  time.Duration
+	openedAt  time.Time
+	probing   bool
+	gauge     metrics.Gauge
+	rejected  metrics.Meter
+}
+
+// NewBreaker returns a new Breaker for the service name. Its state is
+// exported to reg as /circuit/<name>.state.
+func NewBreaker(name string, threshold int, cooldown time.Duration,
+	reg *metrics.Registry) *Breaker {
+	if threshold <= 0 {
+		threshold = 5
+	}
+	if cooldown == 0 {
+		cooldown = 30 * time.Second
+	}
+	return &Breaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+		gauge: metrics.GetOrRegisterGauge(
+			fmt.Sprintf("/circuit/%s.state", name), *reg),
+		rejected: metrics.GetOrRegisterMeter(
+			fmt.Sprintf("/circuit/%s.rejected.per.second", name), *reg),
+	}
+}
+
+// Allow reports if a call may be performed
+func (b *Breaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			b.rejected.Mark(1)
+			return false
+		}
+		b.setState(CircuitHalfOpen)
+		b.probing = true
+		return true
+	case CircuitHalfOpen:
+		if b.probing {
+			b.rejected.Mark(1)
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// Success records a successful call
+func (b *Breaker) Success() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures = 0
+	b.probing = false
+	if b.state != CircuitClosed {
+		logrus.Infof("Circuit[%s], closed", b.name)
+		b.setState(CircuitClosed)
+	}
+}
+
+// Failure records a failed call
+func (b *Breaker) Failure() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.state == CircuitHalfOpen || b.failures >= b.threshold {
+		if b.state != CircuitOpen {
+			logrus.Warnf("Circuit[%s], opened after %d failures", b.name, b.failures)
+		}
+		b.openedAt = time.Now()
+		b.setState(CircuitOpen)
+	}
+}
+
+// State returns the current state of the circuit
+func (b *Breaker) State() int64 {
+	if b == nil {
+		return CircuitClosed
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.state
+}
+
+// setState updates the state of the circuit, the caller must hold the
+// lock
+func (b *Breaker) setState(s int64) {
+	b.state = s
+	b.gauge.Update(s)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
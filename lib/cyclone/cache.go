@@ -0,0 +1,278 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+const (
+	// defaultSoftTTL is the age after which cached thresholds are
+	// refreshed in the background
+	defaultSoftTTL = 1440 * time.Second
+	// defaultHardTTL is the age after which cached thresholds are
+	// dropped
+	defaultHardTTL = 24 * time.Hour
+	// invalidationFence is the time invalidations are remembered to
+	// fence writes of lookups that started before them. Lookups and
+	// prewarming are limited to far shorter timeouts.
+	invalidationFence = time.Hour
+)
+
+// ThresholdCache is the in-process cache for threshold configurations
+// by LookupID that is shared by all handlers. It holds up to size
+// entries, evicting the least recently used ones. Entries older than
+// the soft TTL are served as stale and should be refreshed, entries
+// older than the hard TTL are dropped. Writes are fenced against
+// invalidations with tokens, see Token. A nil ThresholdCache caches
+// nothing.
+type ThresholdCache struct {
+	lock        sync.Mutex
+	size        int
+	softTTL     time.Duration
+	hardTTL     time.Duration
+	entries     map[string]*list.Element
+	order       *list.List
+	epoch       uint64
+	invalidated map[string]cacheFence
+	hits        metrics.Meter
+	misses      metrics.Meter
+	stale       metrics.Meter
+	gauge       metrics.Gauge
+}
+
+// cacheFence records the invalidation of a LookupID
+type cacheFence struct {
+	epoch uint64
+	at    time.Time
+}
+
+// cacheEntry is the element type of ThresholdCache.order
+type cacheEntry struct {
+	lookup     string
+	thresholds map[string]Thresh
+	stored     time.Time
+}
+
+// NewThresholdCache returns a new ThresholdCache for configuration
+// conf
+func NewThresholdCache(conf *Config, reg *metrics.Registry) *ThresholdCache {
+	size := conf.Cyclone.CacheSize
+	if size <= 0 {
+		size = 10000
+	}
+	softTTL := time.Duration(conf.Cyclone.CacheSoftTTL) * time.Second
+	if softTTL == 0 {
+		softTTL = defaultSoftTTL
+	}
+	hardTTL := time.Duration(conf.Cyclone.CacheHardTTL) * time.Second
+	if hardTTL == 0 {
+		hardTTL = defaultHardTTL
+	}
+	if hardTTL < softTTL {
+		hardTTL = softTTL
+	}
+	return &ThresholdCache{
+		size:        size,
+		softTTL:     softTTL,
+		hardTTL:     hardTTL,
+		entries:     make(map[string]*list.Element),
+		order:       list.New(),
+		invalidated: make(map[string]cacheFence),
+		hits: metrics.GetOrRegisterMeter(
+			`/cache/hits.per.second`, *reg),
+		misses: metrics.GetOrRegisterMeter(
+			`/cache/misses.per.second`, *reg),
+		stale: metrics.GetOrRegisterMeter(
+			`/cache/stale.per.second`, *reg),
+		gauge: metrics.GetOrRegisterGauge(
+			`/cache/entries`, *reg),
+	}
+}
+
+// TTL returns the soft and hard TTL of the cache
+func (tc *ThresholdCache) TTL() (time.Duration, time.Duration) {
+	if tc == nil {
+		return defaultSoftTTL, defaultHardTTL
+	}
+	return tc.softTTL, tc.hardTTL
+}
+
+// Size returns the maximum number of entries of the cache
+func (tc *ThresholdCache) Size() int {
+	if tc == nil {
+		return 0
+	}
+	return tc.size
+}
+
+// Get returns the cached thresholds for lookup and reports if there
+// was an entry and if that entry is stale. An empty map is a negative
+// cache entry. The returned map must not be modified.
+func (tc *ThresholdCache) Get(lookup string) (map[string]Thresh, bool, bool) {
+	if tc == nil {
+		return nil, false, false
+	}
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	elem, ok := tc.entries[lookup]
+	if !ok {
+		tc.misses.Mark(1)
+		return nil, false, false
+	}
+	e := elem.Value.(*cacheEntry)
+	age := time.Since(e.stored)
+	if age > tc.hardTTL {
+		tc.remove(elem)
+		tc.misses.Mark(1)
+		return nil, false, false
+	}
+	tc.order.MoveToFront(elem)
+	tc.hits.Mark(1)
+	if age > tc.softTTL {
+		tc.stale.Mark(1)
+		return e.thresholds, true, true
+	}
+	return e.thresholds, true, false
+}
+
+// Token returns the token for writes of thresholds that are read from
+// now on. It must be taken before thresholds are read from redis or
+// the threshold provider.
+func (tc *ThresholdCache) Token() uint64 {
+	if tc == nil {
+		return 0
+	}
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	return tc.epoch
+}
+
+// generation returns the number of the last invalidation of lookup
+func (tc *ThresholdCache) generation(lookup string) uint64 {
+	if tc == nil {
+		return 0
+	}
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	return tc.invalidated[lookup].epoch
+}
+
+// Set stores thr as thresholds for lookup that were retrieved from the
+// lookup service at stored, after token was taken. It reports if thr
+// was stored, which it is not if lookup was invalidated since token was
+// taken.
+func (tc *ThresholdCache) Set(lookup string, thr map[string]Thresh, stored time.Time, token uint64) bool {
+	if tc == nil || thr == nil {
+		return true
+	}
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	if !tc.valid(lookup, token) {
+		return false
+	}
+
+	if elem, ok := tc.entries[lookup]; ok {
+		e := elem.Value.(*cacheEntry)
+		e.thresholds = thr
+		e.stored = stored
+		tc.order.MoveToFront(elem)
+		return true
+	}
+	tc.entries[lookup] = tc.order.PushFront(&cacheEntry{
+		lookup:     lookup,
+		thresholds: thr,
+		stored:     stored,
+	})
+	for tc.order.Len() > tc.size {
+		tc.remove(tc.order.Back())
+	}
+	tc.gauge.Update(int64(tc.order.Len()))
+	return true
+}
+
+// Peek returns the cached thresholds for lookup and when they were
+// retrieved without updating the cache statistics or the LRU order
+func (tc *ThresholdCache) Peek(lookup string) (map[string]Thresh, time.Time, bool) {
+	if tc == nil {
+		return nil, time.Time{}, false
+	}
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	elem, ok := tc.entries[lookup]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	e := elem.Value.(*cacheEntry)
+	return e.thresholds, e.stored, true
+}
+
+// Delete invalidates the entry for lookup. Thresholds for lookup that
+// are read before Delete can no longer be stored.
+func (tc *ThresholdCache) Delete(lookup string) {
+	if tc == nil {
+		return
+	}
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	if elem, ok := tc.entries[lookup]; ok {
+		tc.remove(elem)
+	}
+	now := time.Now()
+	for l, f := range tc.invalidated {
+		if now.Sub(f.at) > invalidationFence {
+			delete(tc.invalidated, l)
+		}
+	}
+	tc.epoch++
+	tc.invalidated[lookup] = cacheFence{epoch: tc.epoch, at: now}
+}
+
+// lookupsFor returns the LookupIDs of all entries that contain the
+// configuration item id
+func (tc *ThresholdCache) lookupsFor(id string) []string {
+	res := []string{}
+	if tc == nil {
+		return res
+	}
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	for lookup, elem := range tc.entries {
+		if _, ok := elem.Value.(*cacheEntry).thresholds[id]; ok {
+			res = append(res, lookup)
+		}
+	}
+	return res
+}
+
+// valid reports if thresholds for lookup that were read after token
+// was taken are still valid, the caller must hold the lock
+func (tc *ThresholdCache) valid(lookup string, token uint64) bool {
+	return tc.invalidated[lookup].epoch <= token
+}
+
+// remove deletes elem from the cache, the caller must hold the lock
+func (tc *ThresholdCache) remove(elem *list.Element) {
+	delete(tc.entries, elem.Value.(*cacheEntry).lookup)
+	tc.order.Remove(elem)
+	tc.gauge.Update(int64(tc.order.Len()))
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,217 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+
+	"github.com/mjolnir42/erebos"
+	ucl "github.com/nahanni/go-ucl"
+)
+
+// Config is the cyclone configuration. The kafka, log, misc, redis
+// and zookeeper sections are read by erebos, the cyclone section is
+// read into AppConfig and replaces the cyclone section of
+// erebos.Config.
+type Config struct {
+	erebos.Config
+	Cyclone AppConfig `json:"cyclone"`
+}
+
+// AppConfig holds the settings of the cyclone section
+type AppConfig struct {
+	DestinationURI       string           `json:"alarming.destination"`
+	APIVersion           string           `json:"api.version"`
+	TestMode             bool             `json:"testmode,string"`
+	LookupHost           string           `json:"lookup.host"`
+	LookupPort           string           `json:"lookup.port"`
+	LookupPath           string           `json:"lookup.path"`
+	MetricsMaxAge        int              `json:"metrics.max.age.minutes,string"`
+	HandlerQueueLength   int              `json:"handler.queue.length,string"`
+	StateTTL             int              `json:"state.ttl.minutes,string"`
+	AlarmBackoffInitial  int              `json:"alarming.backoff.initial.ms,string"`
+	AlarmBackoffMax      int              `json:"alarming.backoff.max.ms,string"`
+	AlarmMaxAge          int              `json:"alarming.max.age.minutes,string"`
+	AlarmBatchSize       int              `json:"alarming.batch.size,string"`
+	AlarmBatchWait       int              `json:"alarming.batch.wait.ms,string"`
+	AlarmConcurrency     int              `json:"alarming.concurrency,string"`
+	AlarmSinks           []SinkConfig     `json:"alarming.sinks"`
+	AlarmRoutes          []RouteConfig    `json:"alarming.routes"`
+	AdminListen          string           `json:"admin.listen"`
+	AdminToken           string           `json:"admin.token"`
+	AlarmMessageTemplate string           `json:"alarming.message.template"`
+	AlarmCheckTemplate   string           `json:"alarming.check.template"`
+	AlarmTemplates       []TemplateConfig `json:"alarming.templates"`
+	AlarmHMACSecret      string           `json:"alarming.hmac.secret"`
+	AlarmAuthToken       string           `json:"alarming.auth.token"`
+	AlarmAuthUser        string           `json:"alarming.auth.user"`
+	AlarmAuthPassword    string           `json:"alarming.auth.password"`
+	AlarmTLSCAFile       string           `json:"alarming.tls.ca.file"`
+	AlarmTLSCertFile     string           `json:"alarming.tls.cert.file"`
+	AlarmTLSKeyFile      string           `json:"alarming.tls.key.file"`
+	AlarmTimeout         int              `json:"alarming.timeout.ms,string"`
+	LookupTimeout        int              `json:"lookup.timeout.ms,string"`
+	CircuitThreshold     int              `json:"circuit.failure.threshold,string"`
+	CircuitCooldown      int              `json:"circuit.cooldown.seconds,string"`
+	CacheSize            int              `json:"cache.size,string"`
+	CacheSoftTTL         int              `json:"cache.soft.ttl.seconds,string"`
+	CacheHardTTL         int              `json:"cache.hard.ttl.seconds,string"`
+	PrewarmTimeout       int              `json:"lookup.prewarm.timeout.seconds,string"`
+	LookupProvider       string           `json:"lookup.provider"`
+	LookupURL            string           `json:"lookup.url"`
+	LookupTLSCAFile      string           `json:"lookup.tls.ca.file"`
+	LookupTLSCertFile    string           `json:"lookup.tls.cert.file"`
+	LookupTLSKeyFile     string           `json:"lookup.tls.key.file"`
+	LookupAuthToken      string           `json:"lookup.auth.token"`
+	LookupAuthUser       string           `json:"lookup.auth.user"`
+	LookupAuthPassword   string           `json:"lookup.auth.password"`
+	LookupRetries        int              `json:"lookup.retries,string"`
+	LookupRetryWait      int              `json:"lookup.retry.wait.ms,string"`
+	LookupFile           string           `json:"lookup.file"`
+}
+
+// SinkConfig is an entry of alarming.sinks. Authentication, request
+// signing and TLS are configured per sink.
+type SinkConfig struct {
+	Name         string   `json:"name"`
+	Type         string   `json:"type"`
+	URI          string   `json:"uri"`
+	Topic        string   `json:"topic"`
+	Path         string   `json:"path"`
+	Levels       []string `json:"levels"`
+	Teams        []string `json:"teams"`
+	HMACSecret   string   `json:"hmac.secret"`
+	AuthToken    string   `json:"auth.token"`
+	AuthUser     string   `json:"auth.user"`
+	AuthPassword string   `json:"auth.password"`
+	TLSCAFile    string   `json:"tls.ca.file"`
+	TLSCertFile  string   `json:"tls.cert.file"`
+	TLSKeyFile   string   `json:"tls.key.file"`
+}
+
+// InsecureAuth reports if s sends a bearer token or basic auth
+// credentials over a URI without TLS
+func (s SinkConfig) InsecureAuth() bool {
+	return insecureAuth(s.URI, s.AuthToken, s.AuthUser)
+}
+
+// insecureAuth reports if credentials would be sent to uri without TLS
+func insecureAuth(uri, token, user string) bool {
+	if token == `` && user == `` {
+		return false
+	}
+	u, err := url.Parse(uri)
+	return err != nil || u.Scheme != `https`
+}
+
+// InsecureLookup reports if the eye lookup provider sends a bearer
+// token or basic auth credentials without TLS. Base URLs built from
+// lookup.host and lookup.port never use TLS.
+func (c *AppConfig) InsecureLookup() bool {
+	return insecureAuth(c.LookupURL, c.LookupAuthToken, c.LookupAuthUser)
+}
+
+// InsecureAdmin reports if the mutating routes of the admin API would
+// be reachable without admin.token from other hosts than the local one
+func (c *AppConfig) InsecureAdmin() bool {
+	if c.AdminListen == `` || c.AdminToken != `` {
+		return false
+	}
+	host, _, err := net.SplitHostPort(c.AdminListen)
+	if err != nil {
+		return true
+	}
+	if host == `localhost` {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || !ip.IsLoopback()
+}
+
+// DefaultSink returns the configuration of the default alarm sink for
+// alarming.destination, which uses the global alarming settings
+func (c *AppConfig) DefaultSink() SinkConfig {
+	return SinkConfig{
+		Name:         `default`,
+		Type:         `http`,
+		URI:          c.DestinationURI,
+		HMACSecret:   c.AlarmHMACSecret,
+		AuthToken:    c.AlarmAuthToken,
+		AuthUser:     c.AlarmAuthUser,
+		AuthPassword: c.AlarmAuthPassword,
+		TLSCAFile:    c.AlarmTLSCAFile,
+		TLSCertFile:  c.AlarmTLSCertFile,
+		TLSKeyFile:   c.AlarmTLSKeyFile,
+	}
+}
+
+// RouteConfig is an entry of alarming.routes
+type RouteConfig struct {
+	Name       string   `json:"name"`
+	Metric     string   `json:"metric"`
+	Monitoring string   `json:"monitoring"`
+	Targethost string   `json:"targethost"`
+	Levels     []string `json:"levels"`
+	Teams      []string `json:"teams"`
+	Sinks      []string `json:"sinks"`
+}
+
+// MatchesAll reports if the route has no match criteria and selects
+// its sinks for every alarm
+func (r RouteConfig) MatchesAll() bool {
+	return r.Metric == `` && r.Monitoring == `` && r.Targethost == `` &&
+		len(r.Levels) == 0 && len(r.Teams) == 0
+}
+
+// TemplateConfig is an entry of alarming.templates
+type TemplateConfig struct {
+	Team         string `json:"team"`
+	MetricPrefix string `json:"metric.prefix"`
+	Message      string `json:"message"`
+	Check        string `json:"check"`
+}
+
+// FromFile sets Config c based on the file contents
+func (c *Config) FromFile(fname string) error {
+	if err := c.Config.FromFile(fname); err != nil {
+		return err
+	}
+
+	var (
+		file, uclJSON []byte
+		uclData       map[string]interface{}
+		err           error
+	)
+	fname, _ = filepath.Abs(fname)
+	fname = filepath.Clean(fname)
+	if file, err = ioutil.ReadFile(fname); err != nil {
+		return err
+	}
+	if uclData, err = ucl.NewParser(bytes.NewReader(file)).Ucl(); err != nil {
+		return err
+	}
+	// take the detour over JSON like erebos to read the cyclone
+	// section into AppConfig
+	if uclJSON, err = json.Marshal(uclData); err != nil {
+		return err
+	}
+	section := struct {
+		Cyclone *AppConfig `json:"cyclone"`
+	}{
+		Cyclone: &c.Cyclone,
+	}
+	return json.Unmarshal(uclJSON, &section)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
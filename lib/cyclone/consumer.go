@@ -0,0 +1,71 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/wvanbergen/kazoo-go"
+)
+
+// consumerWatchInterval is the interval at which WatchConsumer checks
+// the consumer group membership
+const consumerWatchInterval = 5 * time.Second
+
+// WatchConsumer marks the Kafka consumer running while a consumer
+// instance of this host is registered in the consumer group in
+// Zookeeper, independent of messages being delivered. Consumer
+// instance IDs are prefixed with the hostname. WatchConsumer returns
+// once stop is closed, with the consumer marked not running.
+func WatchConsumer(conf *Config, stop chan struct{}) {
+	defer SetConsumerRunning(false)
+
+	host, err := os.Hostname()
+	if err != nil {
+		logrus.Errorf("Consumer, ERROR reading hostname: %s", err)
+		<-stop
+		return
+	}
+	kz, err := kazoo.NewKazooFromConnectionString(
+		conf.Zookeeper.Connect, nil)
+	if err != nil {
+		logrus.Errorf("Consumer, ERROR connecting to Zookeeper: %s", err)
+		<-stop
+		return
+	}
+	defer kz.Close()
+	group := kz.Consumergroup(conf.Kafka.ConsumerGroup)
+
+	tick := time.NewTicker(consumerWatchInterval)
+	defer tick.Stop()
+	for {
+		if instances, err := group.Instances(); err != nil {
+			// keep the last known state
+			logrus.Errorf("Consumer, ERROR reading consumer group %s: %s",
+				conf.Kafka.ConsumerGroup, err)
+		} else {
+			joined := false
+			for _, i := range instances {
+				joined = joined || strings.HasPrefix(i.ID, host+`:`)
+			}
+			SetConsumerRunning(joined)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -15,6 +15,7 @@ import (
 	"math"
 	"time"
 
+	"github.com/mjolnir42/cyclone/lib/cyclone/numeric"
 	"github.com/mjolnir42/legacy"
 )
 
@@ -31,8 +32,9 @@ type CPU struct {
 	Usage    float64
 }
 
-// Update adds m to the next counter tracked by c
-func (c *CPU) Update(m *legacy.MetricSplit) {
+// Update adds m to the next counter tracked by c. It returns an
+// error if the value of m is not numeric.
+func (c *CPU) Update(m *legacy.MetricSplit) error {
 	// ignore metrics for other paths
 	switch m.Path {
 	case `/sys/cpu/count/idle`:
@@ -43,14 +45,11 @@ func (c *CPU) Update(m *legacy.MetricSplit) {
 	case `/sys/cpu/count/system`:
 	case `/sys/cpu/count/user`:
 	default:
-		return
+		return nil
 	}
 
-	if c.AssetID == 0 {
-		c.AssetID = m.AssetID
-	}
-	if c.AssetID != m.AssetID {
-		return
+	if c.AssetID != 0 && c.AssetID != m.AssetID {
+		return nil
 	}
 
 	// only process metrics tagged as cpu, not cpuN
@@ -62,9 +61,16 @@ func (c *CPU) Update(m *legacy.MetricSplit) {
 		}
 	}
 	if !cpuMetric {
-		return
+		return nil
 	}
 
+	// rejected values leave c unchanged
+	val, err := numeric.Int64(m)
+	if err != nil {
+		return err
+	}
+	c.AssetID = m.AssetID
+
 processing:
 	if c.NextTime.IsZero() {
 		c.NextTime = m.TS
@@ -73,33 +79,33 @@ processing:
 	if c.NextTime.Equal(m.TS) {
 		switch m.Path {
 		case `/sys/cpu/count/idle`:
-			c.Next.Idle = m.Value().(int64)
+			c.Next.Idle = val
 			c.Next.SetIdle = true
 		case `/sys/cpu/count/iowait`:
-			c.Next.IoWait = m.Value().(int64)
+			c.Next.IoWait = val
 			c.Next.SetIoWait = true
 		case `/sys/cpu/count/irq`:
-			c.Next.Irq = m.Value().(int64)
+			c.Next.Irq = val
 			c.Next.SetIrq = true
 		case `/sys/cpu/count/nice`:
-			c.Next.Nice = m.Value().(int64)
+			c.Next.Nice = val
 			c.Next.SetNice = true
 		case `/sys/cpu/count/softirq`:
-			c.Next.SoftIrq = m.Value().(int64)
+			c.Next.SoftIrq = val
 			c.Next.SetSoftIrq = true
 		case `/sys/cpu/count/system`:
-			c.Next.System = m.Value().(int64)
+			c.Next.System = val
 			c.Next.SetSystem = true
 		case `/sys/cpu/count/user`:
-			c.Next.User = m.Value().(int64)
+			c.Next.User = val
 			c.Next.SetUser = true
 		}
-		return
+		return nil
 	}
 
 	// out of order metric for old timestamp
 	if c.NextTime.After(m.TS) {
-		return
+		return nil
 	}
 
 	// abandon current next and start new one
@@ -108,6 +114,7 @@ processing:
 		c.Next = counter{}
 		goto processing
 	}
+	return nil
 }
 
 // Calculate checks if the next counter has been fully assembled and
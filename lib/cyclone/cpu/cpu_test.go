@@ -0,0 +1,101 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cpu // import "github.com/mjolnir42/cyclone/lib/cyclone/cpu"
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mjolnir42/legacy"
+)
+
+// rejected are metric values that Update must not accept
+var rejected = []struct {
+	name string
+	typ  string
+	val  legacy.MetricValue
+}{
+	{`string`, `string`, legacy.MetricValue{StrVal: `42`}},
+	{`fractional real`, `real`, legacy.MetricValue{FlpVal: 42.5}},
+	{`NaN`, `real`, legacy.MetricValue{FlpVal: math.NaN()}},
+	{`Inf`, `real`, legacy.MetricValue{FlpVal: math.Inf(1)}},
+	{`real out of range`, `real`, legacy.MetricValue{FlpVal: 1e19}},
+}
+
+func TestCPUUpdate(t *testing.T) {
+	ts := time.Unix(1500000000, 0).UTC()
+	metric := func(typ string, val legacy.MetricValue) *legacy.MetricSplit {
+		return &legacy.MetricSplit{
+			AssetID: 42,
+			Path:    `/sys/cpu/count/idle`,
+			TS:      ts,
+			Type:    typ,
+			Val:     val,
+			Tags:    []string{`cpu`},
+		}
+	}
+
+	// an integral real is accepted
+	c := CPU{}
+	if err := c.Update(metric(`real`, legacy.MetricValue{FlpVal: 100})); err != nil {
+		t.Fatalf("integral real: unexpected error: %s", err)
+	}
+	if c.AssetID != 42 || c.Next.Idle != 100 || !c.Next.SetIdle {
+		t.Errorf("integral real: unexpected state %+v", c)
+	}
+
+	for _, tt := range rejected {
+		for _, start := range []CPU{{}, c} {
+			state := start
+			if err := state.Update(metric(tt.typ, tt.val)); err == nil {
+				t.Errorf("%s: expected error", tt.name)
+			}
+			if !reflect.DeepEqual(state, start) {
+				t.Errorf("%s: state changed from %+v to %+v", tt.name, start, state)
+			}
+		}
+	}
+}
+
+func TestCTXUpdate(t *testing.T) {
+	ts := time.Unix(1500000000, 0).UTC()
+	metric := func(typ string, val legacy.MetricValue) *legacy.MetricSplit {
+		return &legacy.MetricSplit{
+			AssetID: 42,
+			Path:    `/sys/cpu/ctx`,
+			TS:      ts,
+			Type:    typ,
+			Val:     val,
+		}
+	}
+
+	c := CTX{}
+	if _, err := c.Update(metric(`integer`, legacy.MetricValue{IntVal: 100})); err != nil {
+		t.Fatalf("integer: unexpected error: %s", err)
+	}
+	if c.AssetID != 42 || c.CurrValue != 100 {
+		t.Errorf("integer: unexpected state %+v", c)
+	}
+
+	for _, tt := range rejected {
+		for _, start := range []CTX{{}, c} {
+			state := start
+			if _, err := state.Update(metric(tt.typ, tt.val)); err == nil {
+				t.Errorf("%s: expected error", tt.name)
+			}
+			if !reflect.DeepEqual(state, start) {
+				t.Errorf("%s: state changed from %+v to %+v", tt.name, start, state)
+			}
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
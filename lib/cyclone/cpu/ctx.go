@@ -11,6 +11,7 @@ package cpu // import "github.com/mjolnir42/cyclone/lib/cyclone/cpu"
 import (
 	"time"
 
+	"github.com/mjolnir42/cyclone/lib/cyclone/numeric"
 	"github.com/mjolnir42/legacy"
 )
 
@@ -26,37 +27,42 @@ type CTX struct {
 
 // Update adds m to the next counter tracked by c and returns the
 // derived metric if there is a new derived metric to be computed.
-// Otherwise it returns nil.
-func (c *CTX) Update(m *legacy.MetricSplit) *legacy.MetricSplit {
+// Otherwise it returns nil. It returns an error if the value of m is
+// not numeric.
+func (c *CTX) Update(m *legacy.MetricSplit) (*legacy.MetricSplit, error) {
 	// ignore metrics for other paths
 	switch m.Path {
 	case `/sys/cpu/ctx`:
 	default:
-		return nil
+		return nil, nil
 	}
 
-	if c.AssetID == 0 {
-		c.AssetID = m.AssetID
+	if c.AssetID != 0 && c.AssetID != m.AssetID {
+		return nil, nil
 	}
-	if c.AssetID != m.AssetID {
-		return nil
+
+	// rejected values leave c unchanged
+	val, err := numeric.Int64(m)
+	if err != nil {
+		return nil, err
 	}
+	c.AssetID = m.AssetID
 
 	if c.CurrTime.IsZero() {
 		c.CurrTime = m.TS
-		c.CurrValue = m.Value().(int64)
-		return nil
+		c.CurrValue = val
+		return nil, nil
 	}
 
 	// backwards in time
 	if c.CurrTime.After(m.TS) || c.CurrTime.Equal(m.TS) {
-		return nil
+		return nil, nil
 	}
 
 	c.NextTime = m.TS
-	c.NextValue = m.Value().(int64)
+	c.NextValue = val
 
-	return c.calculate()
+	return c.calculate(), nil
 }
 
 // calculate computes the derived metric between the current and next
@@ -10,14 +10,12 @@
 package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -25,6 +23,7 @@ import (
 	"github.com/mjolnir42/cyclone/lib/cyclone/cpu"
 	"github.com/mjolnir42/cyclone/lib/cyclone/disk"
 	"github.com/mjolnir42/cyclone/lib/cyclone/mem"
+	"github.com/mjolnir42/cyclone/lib/cyclone/numeric"
 	"github.com/mjolnir42/erebos"
 	"github.com/mjolnir42/legacy"
 	metrics "github.com/rcrowley/go-metrics"
@@ -33,9 +32,10 @@ import (
 // Handlers is the registry of running application handlers
 var Handlers map[int]erebos.Handler
 
-// AgeCutOff is the duration after which back-processed alarms are
-// ignored and not alerted
-var AgeCutOff time.Duration
+// StateTTL is the duration after which derived metric state for assets
+// and mountpoints that received no updates is evicted. A value of zero
+// disables the eviction.
+var StateTTL time.Duration
 
 func init() {
 	Handlers = make(map[int]erebos.Handler)
@@ -47,14 +47,29 @@ type Cyclone struct {
 	Input         chan *erebos.Transport
 	Shutdown      chan struct{}
 	Death         chan error
-	Config        *erebos.Config
+	Config        *Config
 	Metrics       *metrics.Registry
+	Outbox        *Outbox
+	LookupBreaker *Breaker
+	Cache         *ThresholdCache
+	Provider      ThresholdProvider
 	CPUData       map[int64]cpu.CPU
 	MemData       map[int64]mem.Mem
 	CTXData       map[int64]cpu.CTX
 	DskData       map[int64]map[string]disk.Disk
 	redis         *redis.Client
+	stateLock     sync.RWMutex
+	lastActivity  int64
+	lastHeartbeat int64
+	assetSeen     map[int64]time.Time
+	mountSeen     map[int64]map[string]time.Time
+	silences      []Silence
+	silenceLoad   time.Time
+	lastLevel     map[int64]map[string]int64
+	firing        map[int64]map[string]FiringAlarm
+	templates     *alarmTemplates
 	internalInput chan *legacy.MetricSplit
+	faults        []time.Time
 }
 
 // AlarmEvent is the datatype for sending out alarm notifications
@@ -89,11 +104,7 @@ runloop:
 				// before the closed Shutdown channel
 				continue runloop
 			}
-			if err := c.process(msg); err != nil {
-				c.Death <- err
-				<-c.Shutdown
-				break runloop
-			}
+			c.processSafely(msg)
 		}
 	}
 
@@ -105,13 +116,14 @@ drainloop:
 				// channel is closed
 				break drainloop
 			}
-			c.process(msg)
+			c.processSafely(msg)
 		}
 	}
 }
 
 // process evaluates a metric and raises alarms as required
 func (c *Cyclone) process(msg *erebos.Transport) error {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
 	if msg == nil || msg.Value == nil {
 		logrus.Warnf("Ignoring empty message from: %d", msg.HostID)
 		if msg != nil {
@@ -127,7 +139,9 @@ func (c *Cyclone) process(msg *erebos.Transport) error {
 
 	switch m.Path {
 	case `_internal.cyclone.heartbeat`:
+		atomic.StoreInt64(&c.lastHeartbeat, time.Now().UnixNano())
 		c.heartbeat()
+		c.evict()
 		return nil
 	}
 
@@ -135,102 +149,33 @@ func (c *Cyclone) process(msg *erebos.Transport) error {
 	metrics.GetOrRegisterMeter(`/metrics/processed.per.second`,
 		*c.Metrics).Mark(1)
 
-	switch m.Path {
-	case `/sys/cpu/ctx`:
-		ctx := cpu.CTX{}
-		id := m.AssetID
-		if _, ok := c.CTXData[id]; ok {
-			ctx = c.CTXData[id]
-		}
-		m = ctx.Update(m)
-		c.CTXData[id] = ctx
-
-	case `/sys/cpu/count/idle`:
-		fallthrough
-	case `/sys/cpu/count/iowait`:
-		fallthrough
-	case `/sys/cpu/count/irq`:
-		fallthrough
-	case `/sys/cpu/count/nice`:
-		fallthrough
-	case `/sys/cpu/count/softirq`:
-		fallthrough
-	case `/sys/cpu/count/system`:
-		fallthrough
-	case `/sys/cpu/count/user`:
-		cu := cpu.CPU{}
-		id := m.AssetID
-		if _, ok := c.CPUData[id]; ok {
-			cu = c.CPUData[id]
-		}
-		cu.Update(m)
-		m = cu.Calculate()
-		c.CPUData[id] = cu
-
-	case `/sys/memory/active`:
-		fallthrough
-	case `/sys/memory/buffers`:
-		fallthrough
-	case `/sys/memory/cached`:
-		fallthrough
-	case `/sys/memory/free`:
-		fallthrough
-	case `/sys/memory/inactive`:
-		fallthrough
-	case `/sys/memory/swapfree`:
-		fallthrough
-	case `/sys/memory/swaptotal`:
-		fallthrough
-	case `/sys/memory/total`:
-		mm := mem.Mem{}
-		id := m.AssetID
-		if _, ok := c.MemData[id]; ok {
-			mm = c.MemData[id]
-		}
-		mm.Update(m)
-		m = mm.Calculate()
-		c.MemData[id] = mm
-
-	case `/sys/disk/blk_total`:
-		fallthrough
-	case `/sys/disk/blk_used`:
-		fallthrough
-	case `/sys/disk/blk_read`:
-		fallthrough
-	case `/sys/disk/blk_wrtn`:
-		if len(m.Tags) == 0 {
-			m = nil
-			break
-		}
-		d := disk.Disk{}
-		id := m.AssetID
-		mpt := m.Tags[0]
-		if c.DskData[id] == nil {
-			c.DskData[id] = make(map[string]disk.Disk)
-		}
-		if _, ok := c.DskData[id][mpt]; !ok {
-			c.DskData[id][mpt] = d
-		}
-		if _, ok := c.DskData[id][mpt]; ok {
-			d = c.DskData[id][mpt]
-		}
-		d.Update(m)
-		mArr := d.Calculate()
-		if mArr != nil {
-			for _, mPtr := range mArr {
-				// no deadlock, channel is buffered
-				c.internalInput <- mPtr
-			}
-		}
-		c.DskData[id][mpt] = d
-		m = nil
+	derived, err := c.derive(m)
+	if err != nil {
+		c.reject(err)
+		return nil
 	}
+	m = derived
 
 	if m == nil {
 		logrus.Debugf("Cyclone[%d], Metric has been consumed", c.Num)
 		return nil
 	}
 
+	var intVal int64
+	var flpVal float64
+	switch m.Type {
+	case `integer`:
+		fallthrough
+	case `long`:
+		intVal, err = numeric.Int64(m)
+	case `real`:
+		flpVal, err = numeric.Float64(m)
+	}
+	if err != nil {
+		c.reject(err)
+		return nil
+	}
+
 	lid := m.LookupID()
 	thr := c.Lookup(lid)
 	if thr == nil {
@@ -275,6 +220,9 @@ func (c *Cyclone) process(msg *erebos.Transport) error {
 		}
 	}
 
+	observeAge(*c.Metrics, `/metrics/age.at.evaluation.ms`, m.TS)
+	defer metrics.GetOrRegisterTimer(`/evaluation/duration`,
+		*c.Metrics).UpdateSince(time.Now())
 	evaluations := 0
 
 thrloop:
@@ -309,11 +257,11 @@ thrloop:
 				fallthrough
 			case `long`:
 				broken, fVal = c.cmpInt(thr[key].Predicate,
-					m.Value().(int64),
+					intVal,
 					thrval)
 			case `real`:
 				broken, fVal = c.cmpFlp(thr[key].Predicate,
-					m.Value().(float64),
+					flpVal,
 					thrval)
 			}
 			if broken {
@@ -330,70 +278,55 @@ thrloop:
 			Oncall:     thr[key].Oncall,
 			Targethost: thr[key].MetaTargethost,
 			Timestamp:  time.Now().UTC().Format(time.RFC3339Nano),
-			Check:      fmt.Sprintf("cyclone(%s)", m.Path),
 			Monitoring: thr[key].MetaMonitoring,
 			Team:       thr[key].MetaTeam,
 		}
 		al.Level, _ = strconv.ParseInt(alarmLevel, 10, 64)
-		if alarmLevel == `0` {
-			al.Message = `Ok.`
-		} else {
-			al.Message = fmt.Sprintf(
-				"Metric %s has broken threshold. Value %s %s %d",
-				m.Path,
-				fVal,
-				thr[key].Predicate,
-				brokenThr,
-			)
+		actx := &AlarmContext{
+			Metric:              m.Path,
+			Value:               fVal,
+			Unit:                m.Unit,
+			Predicate:           thr[key].Predicate,
+			Level:               al.Level,
+			PreviousLevel:       c.lastLevel[m.AssetID][thr[key].ID],
+			Threshold:           brokenThr,
+			Thresholds:          thr[key].Thresholds,
+			AssetID:             m.AssetID,
+			Tags:                m.Tags,
+			Timestamp:           m.TS,
+			ConfigurationItemID: thr[key].ID,
+			Oncall:              thr[key].Oncall,
+			Monitoring:          thr[key].MetaMonitoring,
+			Team:                thr[key].MetaTeam,
+			Source:              thr[key].MetaSource,
+			Targethost:          thr[key].MetaTargethost,
+		}
+		if al.Message, al.Check, err = c.templates.render(actx); err != nil {
+			logrus.Errorf("Cyclone[%d], ERROR rendering alarm template for %s: %s", c.Num, thr[key].ID, err)
+			al.Message, al.Check, _ = fallbackTemplates.render(actx)
 		}
 		if al.Oncall == `` {
 			al.Oncall = `No oncall information available`
 		}
+		c.recordLevel(al, m)
 		c.updateEval(thr[key].ID)
-		if c.Config.Cyclone.TestMode {
+		if currentSettings().TestMode {
 			// do not send out alarms in testmode
 			continue thrloop
 		}
+		if c.silenced(m.AssetID, m.Path, thr[key]) {
+			metrics.GetOrRegisterMeter(`/alarms/suppressed.per.second`,
+				*c.Metrics).Mark(1)
+			continue thrloop
+		}
 		alrms := metrics.GetOrRegisterMeter(`/alarms.per.second`,
 			*c.Metrics)
 		alrms.Mark(1)
-		go func(a AlarmEvent) {
-			b := new(bytes.Buffer)
-			aSlice := []AlarmEvent{a}
-			if err := json.NewEncoder(b).Encode(aSlice); err != nil {
-				logrus.Errorf("Cyclone[%d], ERROR json encoding alarm for %s: %s", c.Num, a.EventID, err)
-				return
-			}
-			resp, err := http.Post(
-				c.Config.Cyclone.DestinationURI,
-				`application/json; charset=utf-8`,
-				b,
-			)
-
-			if err != nil {
-				logrus.Errorf("Cyclone[%d], ERROR sending alarm for %s: %s", c.Num, a.EventID, err)
-				return
-			}
-			logrus.Infof("Cyclone[%d], Dispatched alarm for %s at level %d, returncode was %d",
-				c.Num, a.EventID, a.Level, resp.StatusCode)
-			if resp.StatusCode >= 209 {
-				// read response body
-				bt, _ := ioutil.ReadAll(resp.Body)
-				logrus.Errorf("Cyclone[%d], ResponseMsg(%d): %s", c.Num, resp.StatusCode, string(bt))
-				resp.Body.Close()
-
-				// reset buffer and encode JSON again so it can be
-				// logged
-				b.Reset()
-				json.NewEncoder(b).Encode(aSlice)
-				logrus.Errorf("Cyclone[%d], RequestJSON: %s", c.Num, b.String())
-				return
-			}
-			// ensure http.Response.Body is consumed and closed,
-			// otherwise it leaks filehandles
-			io.Copy(ioutil.Discard, resp.Body)
-			resp.Body.Close()
-		}(al)
+		if err = c.enqueueAlarm(al, actx.PreviousLevel, m.Path); err != nil {
+			logrus.Errorf("Cyclone[%d], ERROR queueing alarm for %s: %s", c.Num, al.EventID, err)
+			continue thrloop
+		}
+		c.Outbox.Notify()
 	}
 	if evaluations == 0 {
 		logrus.Debugf("Cyclone[%d], metric %s(%d) matched no configurations", c.Num, m.Path, m.AssetID)
@@ -401,6 +334,123 @@ thrloop:
 	return nil
 }
 
+// derive updates the derived metric state with m. It returns the
+// metric to evaluate, which is either m, a metric calculated from the
+// derived state or nil if there is nothing to evaluate. Metrics with
+// values that can not be used are rejected with an error and leave
+// the derived state unchanged.
+func (c *Cyclone) derive(m *legacy.MetricSplit) (*legacy.MetricSplit, error) {
+	// derived metric state is read by the admin API
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	switch m.Path {
+	case `/sys/cpu/ctx`:
+		ctx := cpu.CTX{}
+		id := m.AssetID
+		if _, ok := c.CTXData[id]; ok {
+			ctx = c.CTXData[id]
+		}
+		derived, err := ctx.Update(m)
+		if err != nil {
+			return nil, err
+		}
+		m = derived
+		c.CTXData[id] = ctx
+		c.touch(id)
+
+	case `/sys/cpu/count/idle`:
+		fallthrough
+	case `/sys/cpu/count/iowait`:
+		fallthrough
+	case `/sys/cpu/count/irq`:
+		fallthrough
+	case `/sys/cpu/count/nice`:
+		fallthrough
+	case `/sys/cpu/count/softirq`:
+		fallthrough
+	case `/sys/cpu/count/system`:
+		fallthrough
+	case `/sys/cpu/count/user`:
+		cu := cpu.CPU{}
+		id := m.AssetID
+		if _, ok := c.CPUData[id]; ok {
+			cu = c.CPUData[id]
+		}
+		if err := cu.Update(m); err != nil {
+			return nil, err
+		}
+		m = cu.Calculate()
+		c.CPUData[id] = cu
+		c.touch(id)
+
+	case `/sys/memory/active`:
+		fallthrough
+	case `/sys/memory/buffers`:
+		fallthrough
+	case `/sys/memory/cached`:
+		fallthrough
+	case `/sys/memory/free`:
+		fallthrough
+	case `/sys/memory/inactive`:
+		fallthrough
+	case `/sys/memory/swapfree`:
+		fallthrough
+	case `/sys/memory/swaptotal`:
+		fallthrough
+	case `/sys/memory/total`:
+		mm := mem.Mem{}
+		id := m.AssetID
+		if _, ok := c.MemData[id]; ok {
+			mm = c.MemData[id]
+		}
+		if err := mm.Update(m); err != nil {
+			return nil, err
+		}
+		m = mm.Calculate()
+		c.MemData[id] = mm
+		c.touch(id)
+
+	case `/sys/disk/blk_total`:
+		fallthrough
+	case `/sys/disk/blk_used`:
+		fallthrough
+	case `/sys/disk/blk_read`:
+		fallthrough
+	case `/sys/disk/blk_wrtn`:
+		if len(m.Tags) == 0 {
+			m = nil
+			break
+		}
+		d := disk.Disk{}
+		id := m.AssetID
+		mpt := m.Tags[0]
+		if c.DskData[id] == nil {
+			c.DskData[id] = make(map[string]disk.Disk)
+		}
+		if _, ok := c.DskData[id][mpt]; !ok {
+			c.DskData[id][mpt] = d
+		}
+		if _, ok := c.DskData[id][mpt]; ok {
+			d = c.DskData[id][mpt]
+		}
+		if err := d.Update(m); err != nil {
+			return nil, err
+		}
+		mArr := d.Calculate()
+		if mArr != nil {
+			for _, mPtr := range mArr {
+				// no deadlock, channel is buffered
+				c.internalInput <- mPtr
+			}
+		}
+		c.DskData[id][mpt] = d
+		c.touchMountpoint(id, mpt)
+		m = nil
+	}
+	return m, nil
+}
+
 // commit marks a message as fully processed
 func (c *Cyclone) commit(msg *erebos.Transport) {
 	msg.Commit <- &erebos.Commit{
@@ -410,6 +460,13 @@ func (c *Cyclone) commit(msg *erebos.Transport) {
 	}
 }
 
+// reject logs and counts a metric whose value can not be used
+func (c *Cyclone) reject(err error) {
+	metrics.GetOrRegisterMeter(`/metrics/rejected.per.second`,
+		*c.Metrics).Mark(1)
+	logrus.Errorf("Cyclone[%d], ERROR rejecting metric: %s", c.Num, err)
+}
+
 // cmpInt compares an integer value against a threshold
 func (c *Cyclone) cmpInt(pred string, value, threshold int64) (bool, string) {
 	fVal := fmt.Sprintf("%d", value)
@@ -20,6 +20,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/mjolnir42/cyclone/lib/cyclone/numeric"
 	"github.com/mjolnir42/legacy"
 )
 
@@ -37,8 +38,9 @@ type Disk struct {
 	BytesFree  int64
 }
 
-// Update adds m to the next counter tracked by d
-func (d *Disk) Update(m *legacy.MetricSplit) {
+// Update adds m to the next counter tracked by d. It returns an
+// error if the value of m is not numeric.
+func (d *Disk) Update(m *legacy.MetricSplit) error {
 	// ignore metrics for other paths
 	switch m.Path {
 	case `/sys/disk/blk_total`:
@@ -46,27 +48,29 @@ func (d *Disk) Update(m *legacy.MetricSplit) {
 	case `/sys/disk/blk_read`:
 	case `/sys/disk/blk_wrtn`:
 	default:
-		return
+		return nil
 	}
 
-	if d.AssetID == 0 {
-		d.AssetID = m.AssetID
-	}
-	if d.AssetID != m.AssetID {
-		return
+	if d.AssetID != 0 && d.AssetID != m.AssetID {
+		return nil
 	}
 
 	// can not contain required mount information
 	if len(m.Tags) == 0 {
-		return
+		return nil
 	}
 
-	if d.Mountpoint == `` {
-		d.Mountpoint = m.Tags[0]
+	if d.Mountpoint != `` && d.Mountpoint != m.Tags[0] {
+		return nil
 	}
-	if d.Mountpoint != m.Tags[0] {
-		return
+
+	// rejected values leave d unchanged
+	val, err := numeric.Int64(m)
+	if err != nil {
+		return err
 	}
+	d.AssetID = m.AssetID
+	d.Mountpoint = m.Tags[0]
 
 processing:
 	if d.NextTime.IsZero() {
@@ -76,24 +80,24 @@ processing:
 	if d.NextTime.Equal(m.TS) {
 		switch m.Path {
 		case `/sys/disk/blk_total`:
-			d.Next.BlkTotal = m.Value().(int64) * 1024
+			d.Next.BlkTotal = val * 1024
 			d.Next.SetBlkTotal = true
 		case `/sys/disk/blk_used`:
-			d.Next.BlkUsed = m.Value().(int64) * 1024
+			d.Next.BlkUsed = val * 1024
 			d.Next.SetBlkUsed = true
 		case `/sys/disk/blk_read`:
-			d.Next.BlkRead = m.Value().(int64) * 512
+			d.Next.BlkRead = val * 512
 			d.Next.SetBlkRead = true
 		case `/sys/disk/blk_wrtn`:
-			d.Next.BlkWrite = m.Value().(int64) * 512
+			d.Next.BlkWrite = val * 512
 			d.Next.SetBlkWrite = true
 		}
-		return
+		return nil
 	}
 
 	// out of order metric for old timestamp
 	if d.NextTime.After(m.TS) {
-		return
+		return nil
 	}
 
 	// abandon current next and start new one
@@ -102,6 +106,7 @@ processing:
 		d.Next = counter{}
 		goto processing
 	}
+	return nil
 }
 
 // Calculate checks if the next counter has been fully assembled and
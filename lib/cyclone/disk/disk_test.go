@@ -0,0 +1,68 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package disk // import "github.com/mjolnir42/cyclone/lib/cyclone/disk"
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mjolnir42/legacy"
+)
+
+func TestDiskUpdate(t *testing.T) {
+	ts := time.Unix(1500000000, 0).UTC()
+	metric := func(typ string, val legacy.MetricValue) *legacy.MetricSplit {
+		return &legacy.MetricSplit{
+			AssetID: 42,
+			Path:    `/sys/disk/blk_total`,
+			TS:      ts,
+			Type:    typ,
+			Val:     val,
+			Tags:    []string{`/srv`},
+		}
+	}
+
+	// an integral real is accepted
+	d := Disk{}
+	if err := d.Update(metric(`real`, legacy.MetricValue{FlpVal: 1024})); err != nil {
+		t.Fatalf("integral real: unexpected error: %s", err)
+	}
+	if d.AssetID != 42 || d.Mountpoint != `/srv` ||
+		d.Next.BlkTotal != 1024*1024 || !d.Next.SetBlkTotal {
+		t.Errorf("integral real: unexpected state %+v", d)
+	}
+
+	tests := []struct {
+		name string
+		typ  string
+		val  legacy.MetricValue
+	}{
+		{`string`, `string`, legacy.MetricValue{StrVal: `1024`}},
+		{`fractional real`, `real`, legacy.MetricValue{FlpVal: 1024.5}},
+		{`NaN`, `real`, legacy.MetricValue{FlpVal: math.NaN()}},
+		{`Inf`, `real`, legacy.MetricValue{FlpVal: math.Inf(1)}},
+		{`real out of range`, `real`, legacy.MetricValue{FlpVal: 1e19}},
+	}
+
+	for _, tt := range tests {
+		for _, start := range []Disk{{}, d} {
+			state := start
+			if err := state.Update(metric(tt.typ, tt.val)); err == nil {
+				t.Errorf("%s: expected error", tt.name)
+			}
+			if !reflect.DeepEqual(state, start) {
+				t.Errorf("%s: state changed from %+v to %+v", tt.name, start, state)
+			}
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -97,9 +97,14 @@ func Dispatch(msg erebos.Transport) error {
 		return nil
 	}
 
+	h := Handlers[msg.HostID%runtime.NumCPU()]
+	if c, ok := h.(*Cyclone); ok {
+		observeAge(*c.Metrics, `/metrics/age.at.dispatch.ms`, m.TS)
+	}
+
 	// ignore metrics that are simply too old for useful
 	// alerting
-	if time.Now().UTC().Add(AgeCutOff).After(m.TS.UTC()) {
+	if time.Now().UTC().Add(currentSettings().AgeCutOff).After(m.TS.UTC()) {
 		// mark as processed
 		msg.Commit <- &erebos.Commit{
 			Topic:     msg.Topic,
@@ -109,7 +114,7 @@ func Dispatch(msg erebos.Transport) error {
 		return nil
 	}
 
-	Handlers[msg.HostID%runtime.NumCPU()].InputChannel() <- &msg
+	h.InputChannel() <- &msg
 	return nil
 }
 
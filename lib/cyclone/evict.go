@@ -0,0 +1,80 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// touch records that derived metric state for asset id has been
+// updated
+func (c *Cyclone) touch(id int64) {
+	c.assetSeen[id] = time.Now().UTC()
+}
+
+// touchMountpoint records that derived metric state for mountpoint
+// mpt of asset id has been updated
+func (c *Cyclone) touchMountpoint(id int64, mpt string) {
+	c.touch(id)
+	if c.mountSeen[id] == nil {
+		c.mountSeen[id] = make(map[string]time.Time)
+	}
+	c.mountSeen[id][mpt] = time.Now().UTC()
+}
+
+// evict removes all derived metric state and alarm levels for assets
+// and mountpoints that have not been updated within StateTTL
+func (c *Cyclone) evict() {
+	if StateTTL == 0 {
+		return
+	}
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	cutoff := time.Now().UTC().Add(-StateTTL)
+	assets := metrics.GetOrRegisterMeter(
+		`/state/evicted.assets.per.second`, *c.Metrics)
+	mounts := metrics.GetOrRegisterMeter(
+		`/state/evicted.mountpoints.per.second`, *c.Metrics)
+
+	for id, seen := range c.assetSeen {
+		if seen.Before(cutoff) {
+			logrus.Debugf("Cyclone[%d], Evicting derived metric state for %d", c.Num, id)
+			delete(c.CPUData, id)
+			delete(c.MemData, id)
+			delete(c.CTXData, id)
+			delete(c.DskData, id)
+			delete(c.lastLevel, id)
+			delete(c.firing, id)
+			delete(c.mountSeen, id)
+			delete(c.assetSeen, id)
+			assets.Mark(1)
+		}
+	}
+
+	for id := range c.mountSeen {
+		for mpt, seen := range c.mountSeen[id] {
+			if seen.Before(cutoff) {
+				logrus.Debugf("Cyclone[%d], Evicting derived metric state for %d:%s", c.Num, id, mpt)
+				delete(c.DskData[id], mpt)
+				delete(c.mountSeen[id], mpt)
+				mounts.Mark(1)
+			}
+		}
+		if len(c.mountSeen[id]) == 0 {
+			delete(c.DskData, id)
+			delete(c.mountSeen, id)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,83 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"sync"
+)
+
+// lookupFlights coalesces the lookup service requests of all handlers
+var lookupFlights = &flightGroup{
+	calls: make(map[string]*flightCall),
+}
+
+// flightCall is an in-flight or completed flightGroup.do call
+type flightCall struct {
+	wg  sync.WaitGroup
+	val map[string]Thresh
+}
+
+// flightGroup ensures that only one call per key is in flight at any
+// time. Concurrent callers for the same key wait for and share the
+// result of the running call.
+type flightGroup struct {
+	lock  sync.Mutex
+	calls map[string]*flightCall
+}
+
+// do executes fn for key unless a call for key is already in flight,
+// in which case it waits for that call. It returns the result of fn
+// and whether it was shared from another caller.
+func (g *flightGroup) do(key string, fn func() map[string]Thresh) (map[string]Thresh, bool) {
+	g.lock.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.lock.Unlock()
+		call.wg.Wait()
+		return call.val, true
+	}
+	call := &flightCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.lock.Unlock()
+
+	defer func() {
+		g.lock.Lock()
+		delete(g.calls, key)
+		g.lock.Unlock()
+		call.wg.Done()
+	}()
+	call.val = fn()
+	return call.val, false
+}
+
+// async starts fn for key in the background unless a call for key is
+// already in flight
+func (g *flightGroup) async(key string, fn func() map[string]Thresh) {
+	g.lock.Lock()
+	if _, ok := g.calls[key]; ok {
+		g.lock.Unlock()
+		return
+	}
+	call := &flightCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.lock.Unlock()
+
+	go func() {
+		defer func() {
+			g.lock.Lock()
+			delete(g.calls, key)
+			g.lock.Unlock()
+			call.wg.Done()
+		}()
+		call.val = fn()
+	}()
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -19,18 +19,67 @@ import (
 // via legacy.MetricSocket, implementing legacy.Formatter
 func FormatMetrics(batch *legacy.PluginMetricBatch) func(string, interface{}) {
 	return func(metric string, v interface{}) {
-		switch v.(type) {
-		case *metrics.StandardMeter:
-			value := v.(*metrics.StandardMeter)
-			batch.Metrics = append(batch.Metrics, legacy.PluginMetric{
-				Type:   `float`,
-				Metric: fmt.Sprintf("%s/avg/rate/1min", metric),
-				Value: legacy.MetricValue{
-					FlpVal: value.Rate1(),
-				},
-			})
+		switch value := v.(type) {
+		case metrics.Counter:
+			addInt(batch, metric, `count`, value.Count())
+		case metrics.Gauge:
+			addInt(batch, metric, `value`, value.Value())
+		case metrics.GaugeFloat64:
+			addFlp(batch, metric, `value`, value.Value())
+		case metrics.Meter:
+			s := value.Snapshot()
+			addFlp(batch, metric, `avg/rate/1min`, s.Rate1())
+			addFlp(batch, metric, `avg/rate/5min`, s.Rate5())
+			addFlp(batch, metric, `avg/rate/15min`, s.Rate15())
+			addInt(batch, metric, `count`, s.Count())
+		case metrics.Histogram:
+			formatSample(batch, metric, value.Snapshot())
+		case metrics.Timer:
+			formatSample(batch, metric, value.Snapshot())
 		}
 	}
 }
 
+// sample is the common interface of histogram and timer snapshots
+type sample interface {
+	Count() int64
+	Mean() float64
+	Max() int64
+	Percentiles([]float64) []float64
+}
+
+// formatSample adds the count, mean, p50, p95, p99 and max of s to
+// batch
+func formatSample(batch *legacy.PluginMetricBatch, metric string, s sample) {
+	ps := s.Percentiles([]float64{0.5, 0.95, 0.99})
+	addInt(batch, metric, `count`, s.Count())
+	addFlp(batch, metric, `mean`, s.Mean())
+	addFlp(batch, metric, `p50`, ps[0])
+	addFlp(batch, metric, `p95`, ps[1])
+	addFlp(batch, metric, `p99`, ps[2])
+	addInt(batch, metric, `max`, s.Max())
+}
+
+// addInt adds an integer value for metric/suffix to batch
+func addInt(batch *legacy.PluginMetricBatch, metric, suffix string, val int64) {
+	batch.Metrics = append(batch.Metrics, legacy.PluginMetric{
+		Type:   `integer`,
+		Metric: fmt.Sprintf("%s/%s", metric, suffix),
+		Value: legacy.MetricValue{
+			IntVal: val,
+		},
+	})
+}
+
+// addFlp adds a floating point value for metric/suffix to batch
+func addFlp(batch *legacy.PluginMetricBatch, metric, suffix string, val float64) {
+	batch.Metrics = append(batch.Metrics, legacy.PluginMetric{
+		Type:   `float`,
+		Metric: fmt.Sprintf("%s/%s", metric, suffix),
+		Value: legacy.MetricValue{
+			FlpVal: val,
+		},
+	})
+}
+
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -10,11 +10,9 @@ package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/go-redis/redis"
-	"github.com/mjolnir42/cyclone/lib/cyclone/cpu"
-	"github.com/mjolnir42/cyclone/lib/cyclone/disk"
-	"github.com/mjolnir42/cyclone/lib/cyclone/mem"
 	"github.com/mjolnir42/erebos"
 	"github.com/mjolnir42/legacy"
 )
@@ -29,26 +27,45 @@ func (c *Cyclone) Start() {
 		return
 	}
 
-	c.CPUData = make(map[int64]cpu.CPU)
-	c.MemData = make(map[int64]mem.Mem)
-	c.CTXData = make(map[int64]cpu.CTX)
-	c.DskData = make(map[int64]map[string]disk.Disk)
-	c.internalInput = make(chan *legacy.MetricSplit, 32)
-	c.redis = redis.NewClient(&redis.Options{
-		Addr:     c.Config.Redis.Connect,
-		Password: c.Config.Redis.Password,
-		DB:       int(c.Config.Redis.DB),
-	})
-	if _, err := c.redis.Ping().Result(); err != nil {
+	if err := c.setup(); err != nil {
 		c.Death <- err
 		<-c.Shutdown
 		return
 	}
-	defer c.redis.Close()
+	// redis is an optional second tier cache
+	if c.Config.Redis.Connect != `` {
+		c.redis = redis.NewClient(&redis.Options{
+			Addr:     c.Config.Redis.Connect,
+			Password: c.Config.Redis.Password,
+			DB:       int(c.Config.Redis.DB),
+		})
+		if _, err := c.redis.Ping().Result(); err != nil {
+			c.Death <- err
+			<-c.Shutdown
+			return
+		}
+		defer c.redis.Close()
+	}
 
 	c.run()
 }
 
+// setup initializes the state of the handler and its alarm templates.
+// The previous templates are kept if the new ones can not be built.
+func (c *Cyclone) setup() error {
+	templates, err := newAlarmTemplates(c.Config)
+	if err != nil {
+		return err
+	}
+	c.resetState()
+	c.internalInput = make(chan *legacy.MetricSplit, 32)
+	c.templates = templates
+	c.silences = nil
+	c.silenceLoad = time.Time{}
+	c.faults = nil
+	return nil
+}
+
 // InputChannel returns the data input channel
 func (c *Cyclone) InputChannel() chan *erebos.Transport {
 	return c.Input
@@ -0,0 +1,133 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// HeartbeatInterval is the interval at which main sends a heartbeat to
+// one of the handlers in turn
+var HeartbeatInterval = 5 * time.Second
+
+// consumerRunning is set while the Kafka consumer is running
+var consumerRunning int32
+
+// ConsumerRunning reports whether the Kafka consumer is running
+func ConsumerRunning() bool {
+	return atomic.LoadInt32(&consumerRunning) == 1
+}
+
+// SetConsumerRunning records whether the Kafka consumer is running. The
+// consumer is running while it has joined its consumer group, see
+// WatchConsumer.
+func SetConsumerRunning(running bool) {
+	if running {
+		atomic.StoreInt32(&consumerRunning, 1)
+		return
+	}
+	atomic.StoreInt32(&consumerRunning, 0)
+}
+
+// Readiness is the result of the readiness checks. Every check is
+// either ok or the reason it failed.
+type Readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// healthz reports that the process is alive
+func (a *Admin) healthz(w http.ResponseWriter, r *http.Request,
+	_ httprouter.Params) {
+	w.Header().Set(`Content-Type`, `text/plain`)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+// readyz reports if cyclone is able to process metrics
+func (a *Admin) readyz(w http.ResponseWriter, r *http.Request,
+	_ httprouter.Params) {
+	res := a.readiness()
+	if !res.Ready {
+		a.writeJSON(w, http.StatusServiceUnavailable, res)
+		return
+	}
+	a.writeJSON(w, http.StatusOK, res)
+}
+
+// readiness checks redis, the Kafka consumer, the handler heartbeats
+// and the reachability of the lookup service
+func (a *Admin) readiness() Readiness {
+	res := Readiness{
+		Ready:  true,
+		Checks: make(map[string]string),
+	}
+	fail := func(check, reason string) {
+		res.Ready = false
+		res.Checks[check] = reason
+	}
+
+	switch {
+	case a.redis == nil:
+		res.Checks[`redis`] = `not configured`
+	default:
+		if err := a.redis.Ping().Err(); err != nil {
+			fail(`redis`, err.Error())
+		} else {
+			res.Checks[`redis`] = `ok`
+		}
+	}
+
+	if ConsumerRunning() {
+		res.Checks[`consumer`] = `ok`
+	} else {
+		fail(`consumer`, `not running`)
+	}
+
+	handlers := cyclones()
+	// every handler receives a heartbeat once per round
+	maxAge := 3 * HeartbeatInterval * time.Duration(len(handlers))
+	res.Checks[`handlers`] = `ok`
+	for _, c := range handlers {
+		ts := atomic.LoadInt64(&c.lastHeartbeat)
+		if ts == 0 {
+			fail(`handlers`, fmt.Sprintf(
+				"handler %d has not processed a heartbeat", c.Num))
+			break
+		}
+		if age := time.Since(time.Unix(0, ts)); age > maxAge {
+			fail(`handlers`, fmt.Sprintf(
+				"handler %d processed its last heartbeat %s ago",
+				c.Num, age))
+			break
+		}
+	}
+	if len(handlers) == 0 {
+		fail(`handlers`, `no handlers registered`)
+	}
+
+	switch {
+	case a.provider == nil:
+		res.Checks[`lookup`] = `not configured`
+	default:
+		if err := a.provider.Probe(); err != nil {
+			fail(`lookup`, err.Error())
+		} else {
+			res.Checks[`lookup`] = `ok`
+		}
+	}
+	return res
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,101 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// newTLSConfig returns the TLS client configuration for the CA bundle
+// in caFile and the client certificate in certFile and keyFile. It
+// returns nil if none of them are set.
+func newTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	if caFile == `` && certFile == `` && keyFile == `` {
+		return nil, nil
+	}
+	cfg := &tls.Config{}
+
+	if caFile != `` {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if certFile != `` || keyFile != `` {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// newHTTPClient returns an http.Client using tlsConfig with requests
+// limited to timeout
+func newHTTPClient(tlsConfig *tls.Config, timeout time.Duration) *http.Client {
+	if tlsConfig == nil {
+		return &http.Client{Timeout: timeout}
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+}
+
+// httpAuth holds the credentials for outgoing HTTP requests
+type httpAuth struct {
+	token    string
+	user     string
+	password string
+	secret   string
+}
+
+// apply sets the authentication headers for req. If a signing secret
+// is configured, body is signed using HMAC-SHA256 over the timestamp
+// header, a dot and the body.
+func (h httpAuth) apply(req *http.Request, body []byte) {
+	switch {
+	case h.token != ``:
+		req.Header.Set(`Authorization`, `Bearer `+h.token)
+	case h.user != ``:
+		req.SetBasicAuth(h.user, h.password)
+	}
+
+	if h.secret != `` {
+		ts := strconv.FormatInt(time.Now().UTC().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(h.secret))
+		mac.Write([]byte(ts))
+		mac.Write([]byte(`.`))
+		mac.Write(body)
+		req.Header.Set(`X-Cyclone-Timestamp`, ts)
+		req.Header.Set(`X-Cyclone-Signature`,
+			`sha256=`+hex.EncodeToString(mac.Sum(nil)))
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,36 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// NewAgeSample returns the sample used for the metric age histograms
+func NewAgeSample() metrics.Sample {
+	return metrics.NewExpDecaySample(1028, 0.015)
+}
+
+// observeAge records the age in milliseconds of a metric with
+// timestamp ts in the histogram name of reg
+func observeAge(reg metrics.Registry, name string, ts time.Time) {
+	metrics.GetOrRegisterHistogram(name, reg, NewAgeSample()).Update(
+		int64(time.Since(ts) / time.Millisecond))
+}
+
+// timeRedis records the duration of a redis operation that began at
+// start
+func (c *Cyclone) timeRedis(start time.Time) {
+	metrics.GetOrRegisterTimer(`/redis/duration`,
+		*c.Metrics).UpdateSince(start)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
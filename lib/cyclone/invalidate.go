@@ -0,0 +1,110 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-redis/redis"
+	"github.com/mjolnir42/legacy"
+)
+
+// Invalidation is a notification that the threshold configuration for
+// a LookupID or a configuration item has changed
+type Invalidation struct {
+	LookupID            string `json:"lookup_id,omitempty"`
+	ConfigurationItemID string `json:"configuration_item_id,omitempty"`
+}
+
+// Validate checks that i names exactly one LookupID or configuration
+// item
+func (i *Invalidation) Validate() error {
+	switch {
+	case i.LookupID == `` && i.ConfigurationItemID == ``:
+		return fmt.Errorf("Invalidation requires lookup_id or configuration_item_id")
+	case i.LookupID != `` && i.ConfigurationItemID != ``:
+		return fmt.Errorf("Invalidation accepts only one of lookup_id and configuration_item_id")
+	}
+	return nil
+}
+
+// invalidate drops the cached thresholds affected by i from the
+// in-process cache and, if client is not nil, from redis. It returns
+// the invalidated LookupIDs.
+func invalidate(client *redis.Client, cache *ThresholdCache, i *Invalidation) ([]string, error) {
+	lookups := []string{}
+	if i.LookupID != `` {
+		lookups = append(lookups, i.LookupID)
+	} else {
+		lookups = append(lookups, cache.lookupsFor(i.ConfigurationItemID)...)
+		if client != nil {
+			lookup, err := redisLookupFor(client, i.ConfigurationItemID)
+			if err != nil {
+				return nil, err
+			}
+			if lookup != `` && !contains(lookups, lookup) {
+				lookups = append(lookups, lookup)
+			}
+		}
+	}
+
+	for _, lookup := range lookups {
+		cache.Delete(lookup)
+		if client == nil {
+			continue
+		}
+		ids, err := client.HKeys(lookup).Result()
+		if err != nil {
+			return nil, err
+		}
+		keys := []string{lookup}
+		for _, id := range ids {
+			if id != `unconfigured` {
+				keys = append(keys, id)
+			}
+		}
+		if err := client.Del(keys...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return lookups, nil
+}
+
+// redisLookupFor returns the LookupID of the configuration item id
+// stored in redis, or an empty string if it is not cached
+func redisLookupFor(client *redis.Client, id string) (string, error) {
+	val, err := client.Get(id).Result()
+	switch {
+	case err == redis.Nil:
+		return ``, nil
+	case err != nil:
+		return ``, err
+	}
+	t := Thresh{}
+	if err := json.Unmarshal([]byte(val), &t); err != nil {
+		return ``, err
+	}
+	return (&legacy.MetricSplit{
+		AssetID: int64(t.HostID),
+		Path:    t.Metric,
+	}).LookupID(), nil
+}
+
+// contains reports if s is an element of list
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -12,12 +12,12 @@ package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/go-redis/redis"
+	metrics "github.com/rcrowley/go-metrics"
 )
 
 // Thresh is the internal datastructure for monitoring profile
@@ -37,40 +37,116 @@ type Thresh struct {
 }
 
 // Lookup reads the configured thresholds for lookup. At first it reads
-// from the local cache, then checks the lookup service if the cache
-// contains no entry. It sets negative cache entries inside the local
-// cache if lookup has no associated entries. It returns nil if there
-// are no threshold configurations.
+// from the in-process cache, then from the local redis cache and then
+// checks the lookup service if neither contains an entry. It sets
+// negative cache entries if lookup has no associated entries. It
+// returns nil if there are no threshold configurations. Concurrent
+// cache misses for the same lookup from all handlers are coalesced into
+// a single resolution. Entries older than the soft TTL are returned
+// while they are refreshed in the background. Resolutions that were
+// started before an invalidation of lookup are not joined.
 func (c *Cyclone) Lookup(lookup string) map[string]Thresh {
-	thr := c.getThreshold(lookup)
-	if thr != nil {
+	if thr, ok, stale := c.Cache.Get(lookup); ok {
+		if stale {
+			c.revalidate(lookup)
+		}
 		return thr
 	}
-	dat := c.fetchFromLookupService(lookup)
-	if dat == nil {
-		logrus.Errorf("Cyclone[%d], ERROR Lookup received nil from fetcher for %s", c.Num, lookup)
-		c.storeUnconfigured(lookup)
+	thr, shared := lookupFlights.do(c.flightKey(lookup), func() map[string]Thresh {
+		return c.resolve(lookup)
+	})
+	if shared {
+		metrics.GetOrRegisterMeter(`/lookup/coalesced.per.second`,
+			*c.Metrics).Mark(1)
+	}
+	return thr
+}
+
+// resolve reads the configured thresholds for lookup from the local
+// redis cache or the lookup service and stores them in the in-process
+// cache. Entries from redis keep their original age, so a stale entry
+// is revalidated on its next use.
+func (c *Cyclone) resolve(lookup string) map[string]Thresh {
+	token := c.Cache.Token()
+	if thr, stored := c.getThreshold(lookup); thr != nil {
+		c.Cache.Set(lookup, thr, stored, token)
+		return thr
+	}
+	return c.refresh(lookup)
+}
+
+// revalidate refreshes the thresholds for lookup in the background
+func (c *Cyclone) revalidate(lookup string) {
+	metrics.GetOrRegisterMeter(`/lookup/revalidations.per.second`,
+		*c.Metrics).Mark(1)
+	lookupFlights.async(c.flightKey(lookup), func() map[string]Thresh {
+		return c.refresh(lookup)
+	})
+}
+
+// flightKey returns the key of lookup in lookupFlights, which changes
+// whenever lookup is invalidated
+func (c *Cyclone) flightKey(lookup string) string {
+	return fmt.Sprintf("%s/%d", lookup, c.Cache.generation(lookup))
+}
+
+// refresh fetches the thresholds for lookup from the threshold
+// provider and stores them in both caches. If the provider can not be
+// queried, existing cache entries are kept and nil is returned. The
+// result is reported to the lookup circuit breaker. If lookup is
+// invalidated while the provider is queried, the result is returned
+// but not cached.
+func (c *Cyclone) refresh(lookup string) map[string]Thresh {
+	if !c.LookupBreaker.Allow() {
+		logrus.Debugf("Cyclone[%d], Circuit open, skipping lookup for %s", c.Num, lookup)
+		return nil
+	}
+	logrus.Debugf("Cyclone[%d], Looking up configuration data for %s", c.Num, lookup)
+	token := c.Cache.Token()
+	start := time.Now()
+	dat, err := c.Provider.Fetch(lookup)
+	metrics.GetOrRegisterTimer(`/lookup/duration`,
+		*c.Metrics).UpdateSince(start)
+	if err != nil {
+		logrus.Errorf("Cyclone[%d], ERROR during lookup for %s: %s", c.Num, lookup, err)
+		c.LookupBreaker.Failure()
 		return nil
 	}
-	c.processConfigurationData(lookup, dat)
-	thr = c.getThreshold(lookup)
+	c.LookupBreaker.Success()
+	thr := c.processConfigurationData(lookup, dat)
+	if !c.Cache.Set(lookup, thr, time.Now().UTC(), token) {
+		// the invalidation may have run before the redis write
+		logrus.Infof("Cyclone[%d], Discarding thresholds for %s invalidated during lookup", c.Num, lookup)
+		c.dropThresholds(lookup)
+	}
 	return thr
 }
 
 // getThreshold reads the threshold configuration for lookup from the
-// local cache
-func (c *Cyclone) getThreshold(lookup string) map[string]Thresh {
+// local redis cache. It also returns when the entry was stored, which
+// is the oldest timestamp of its threshold configurations.
+func (c *Cyclone) getThreshold(lookup string) (map[string]Thresh, time.Time) {
+	var stored time.Time
+	if c.redis == nil {
+		return nil, stored
+	}
+	defer c.timeRedis(time.Now())
 	res := make(map[string]Thresh)
 	mapdata, err := c.redis.HGetAll(lookup).Result()
 	if err != nil {
 		logrus.Errorf("Cyclone[%d], ERROR reading from redis for %s: %s", c.Num, lookup, err)
-		return nil
+		return nil, stored
 	}
 	if len(mapdata) == 0 {
 		logrus.Infof("Cyclone[%d], no entry in redis for %s", c.Num, lookup)
-		return nil
+		return nil, stored
 	}
-	for k := range mapdata {
+	for k, v := range mapdata {
+		if ts, err := time.Parse(time.RFC3339, v); err == nil {
+			if stored.IsZero() || ts.Before(stored) {
+				stored = ts
+			}
+		}
 		if k == `unconfigured` {
 			logrus.Debugf("Cyclone[%d], Found negative caching in redis for %s", c.Num, lookup)
 			continue
@@ -78,115 +154,113 @@ func (c *Cyclone) getThreshold(lookup string) map[string]Thresh {
 		val, err := c.redis.Get(k).Result()
 		if err != nil {
 			logrus.Errorf("Cyclone[%d], ERROR reading from redis for %s: %s", c.Num, lookup, err)
-			return nil
+			return nil, stored
 		}
 		t := Thresh{}
 		err = json.Unmarshal([]byte(val), &t)
 		if err != nil {
 			logrus.Errorf("Cyclone[%d], ERROR decoding threshold from redis for %s: %s", c.Num, lookup, err)
-			return nil
+			return nil, stored
 		}
 		res[t.ID] = t
 	}
-	return res
-}
-
-// fetchFromLookupService queries the monitoring profile lookup server
-// for all configurations matching a legacy.MetricSplit.LookupID
-func (c *Cyclone) fetchFromLookupService(lookup string) *ConfigurationData {
-	logrus.Debugf("Cyclone[%d], Looking up configuration data for %s", c.Num, lookup)
-	client := &http.Client{}
-	req, err := http.NewRequest(`GET`, fmt.Sprintf(
-		"http://%s:%s/%s/%s",
-		c.Config.Cyclone.LookupHost,
-		c.Config.Cyclone.LookupPort,
-		c.Config.Cyclone.LookupPath,
-		lookup,
-	), nil)
-	if err != nil {
-		logrus.Errorf("Cyclone[%d], ERROR assembling lookup request: %s", c.Num, err)
-		return nil
-	}
-
-	if resp, err := client.Do(req); err != nil {
-		logrus.Errorf("Cyclone[%d], ERROR during lookup request: %s", c.Num, err)
-		return nil
-	} else if resp.StatusCode == 404 {
-		logrus.Debugf("Cyclone[%d], no configurations for %s", c.Num, lookup)
-		c.storeUnconfigured(lookup)
-		return &ConfigurationData{}
-	} else {
-		var buf []byte
-		buf, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			logrus.Errorf("Cyclone[%d], ERROR reading result body for %s: %s", c.Num, lookup, err)
-			return nil
-		}
-		resp.Body.Close()
-
-		d := &ConfigurationData{}
-		err = json.Unmarshal(buf, d)
-		if err != nil {
-			logrus.Errorf("Cyclone[%d], ERROR decoding result body for %s: %s", c.Num, lookup, err)
-			return nil
-		}
-		return d
-	}
+	return res, stored
 }
 
 // processConfigurationData fully processes t by converting it into
-// Thresh and having it stored within the local cache
-func (c *Cyclone) processConfigurationData(lookup string, t *ConfigurationData) {
-	if t.Configurations == nil {
-		return
-	}
+// Thresh and having it stored within the local redis cache. It returns
+// the converted thresholds.
+func (c *Cyclone) processConfigurationData(lookup string, t *ConfigurationData) map[string]Thresh {
+	res := make(map[string]Thresh)
+	c.dropThresholds(lookup)
 	if len(t.Configurations) == 0 {
 		c.storeUnconfigured(lookup)
-		return
+		return res
 	}
 	for _, i := range t.Configurations {
-		t := Thresh{
-			ID:             i.ConfigurationItemID,
-			Metric:         i.Metric,
-			HostID:         i.HostID,
-			Oncall:         i.Oncall,
-			Interval:       i.Interval,
-			MetaMonitoring: i.Metadata.Monitoring,
-			MetaTeam:       i.Metadata.Team,
-			MetaSource:     i.Metadata.Source,
-			MetaTargethost: i.Metadata.Targethost,
-		}
-		t.Thresholds = make(map[string]int64)
-		for _, l := range i.Thresholds {
-			lvl := strconv.FormatUint(uint64(l.Level), 10)
-			t.Predicate = l.Predicate
-			t.Thresholds[lvl] = l.Value
-		}
+		t := newThresh(&i)
 		c.storeThreshold(lookup, &t)
+		res[t.ID] = t
 	}
+	return res
 }
 
-// storeThreshold writes t into the local cache
+// newThresh converts the ConfigurationItem i into a Thresh
+func newThresh(i *ConfigurationItem) Thresh {
+	t := Thresh{
+		ID:             i.ConfigurationItemID,
+		Metric:         i.Metric,
+		HostID:         i.HostID,
+		Oncall:         i.Oncall,
+		Interval:       i.Interval,
+		MetaMonitoring: i.Metadata.Monitoring,
+		MetaTeam:       i.Metadata.Team,
+		MetaSource:     i.Metadata.Source,
+		MetaTargethost: i.Metadata.Targethost,
+	}
+	t.Thresholds = make(map[string]int64)
+	for _, l := range i.Thresholds {
+		lvl := strconv.FormatUint(uint64(l.Level), 10)
+		t.Predicate = l.Predicate
+		t.Thresholds[lvl] = l.Value
+	}
+	return t
+}
+
+// storeThreshold writes t into the local redis cache
 func (c *Cyclone) storeThreshold(lookup string, t *Thresh) {
+	if c.redis == nil {
+		return
+	}
+	defer c.timeRedis(time.Now())
+	_, ttl := c.Cache.TTL()
+	if err := writeThreshold(c.redis, lookup, t, ttl); err != nil {
+		logrus.Errorf("%s: ERROR (storeThreshold) converting threshold data: %s", lookup, err)
+	}
+}
+
+// writeThreshold writes t as part of lookup into redis, expiring after
+// ttl
+func writeThreshold(r redis.Cmdable, lookup string, t *Thresh, ttl time.Duration) error {
 	buf, err := json.Marshal(t)
 	if err != nil {
-		logrus.Errorf("%s: ERROR (storeThreshold) converting threshold data: %s", lookup, err)
-		return
+		return err
 	}
-	c.redis.Set(t.ID, string(buf), 1440*time.Second)
+	r.Set(t.ID, string(buf), ttl)
 
-	c.redis.HSet(lookup, t.ID, time.Now().UTC().Format(time.RFC3339))
-	c.redis.Expire(lookup, 1440*time.Second)
+	r.HSet(lookup, t.ID, time.Now().UTC().Format(time.RFC3339))
+	r.Expire(lookup, ttl)
+	return nil
+}
+
+// dropThresholds removes the entry for lookup from the local redis
+// cache, so a refreshed configuration does not retain deleted items
+func (c *Cyclone) dropThresholds(lookup string) {
+	if c.redis == nil {
+		return
+	}
+	defer c.timeRedis(time.Now())
+	if err := c.redis.Del(lookup).Err(); err != nil {
+		logrus.Errorf("Cyclone[%d], ERROR removing %s from redis: %s", c.Num, lookup, err)
+	}
 }
 
 // updateEval updates the timestamp of the last evaluation of id inside
 // the local cache
 func (c *Cyclone) updateEval(id string) {
+	if c.redis == nil {
+		return
+	}
+	defer c.timeRedis(time.Now())
 	c.redis.HSet(`evaluation`, id, time.Now().UTC().Format(time.RFC3339))
 }
 
 // heartbeat updates the heartbeat record inside the local cache
 func (c *Cyclone) heartbeat() {
+	if c.redis == nil {
+		return
+	}
+	defer c.timeRedis(time.Now())
 	logrus.Debugf("Cyclone[%d], Updating cyclone heartbeat", c.Num)
 	if _, err := c.redis.HSet(`heartbeat`, `cyclone-alive`, time.Now().UTC().Format(time.RFC3339)).Result(); err != nil {
 		logrus.Errorf("Cyclone[%d], ERROR setting heartbeat in redis: %s", c.Num, err)
@@ -199,8 +273,13 @@ func (c *Cyclone) heartbeat() {
 // storeUnconfigured writes a negative cache entry into the local cache
 // that lookup is a LookupID with no configured profiles
 func (c *Cyclone) storeUnconfigured(lookup string) {
+	if c.redis == nil {
+		return
+	}
+	defer c.timeRedis(time.Now())
+	_, ttl := c.Cache.TTL()
 	c.redis.HSet(lookup, `unconfigured`, time.Now().UTC().Format(time.RFC3339))
-	c.redis.Expire(lookup, 1440*time.Second)
+	c.redis.Expire(lookup, ttl)
 }
 
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -16,6 +16,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/mjolnir42/cyclone/lib/cyclone/numeric"
 	"github.com/mjolnir42/legacy"
 )
 
@@ -30,8 +31,9 @@ type Mem struct {
 	Usage    float64
 }
 
-// Update adds mtr to the next distribution tracked by Mem
-func (m *Mem) Update(mtr *legacy.MetricSplit) {
+// Update adds mtr to the next distribution tracked by Mem. It returns
+// an error if the value of mtr is not numeric.
+func (m *Mem) Update(mtr *legacy.MetricSplit) error {
 	// ignore metrics for other paths
 	switch mtr.Path {
 	case `/sys/memory/active`:
@@ -43,15 +45,19 @@ func (m *Mem) Update(mtr *legacy.MetricSplit) {
 	case `/sys/memory/swaptotal`:
 	case `/sys/memory/total`:
 	default:
-		return
+		return nil
 	}
 
-	if m.AssetID == 0 {
-		m.AssetID = mtr.AssetID
+	if m.AssetID != 0 && m.AssetID != mtr.AssetID {
+		return nil
 	}
-	if m.AssetID != mtr.AssetID {
-		return
+
+	// rejected values leave m unchanged
+	val, err := numeric.Int64(mtr)
+	if err != nil {
+		return err
 	}
+	m.AssetID = mtr.AssetID
 
 processing:
 	if m.NextTime.IsZero() {
@@ -61,36 +67,36 @@ processing:
 	if m.NextTime.Equal(mtr.TS) {
 		switch mtr.Path {
 		case `/sys/memory/active`:
-			m.Next.Active = mtr.Value().(int64)
+			m.Next.Active = val
 			m.Next.SetActive = true
 		case `/sys/memory/buffers`:
-			m.Next.Buffers = mtr.Value().(int64)
+			m.Next.Buffers = val
 			m.Next.SetBuffers = true
 		case `/sys/memory/cached`:
-			m.Next.Cached = mtr.Value().(int64)
+			m.Next.Cached = val
 			m.Next.SetCached = true
 		case `/sys/memory/free`:
-			m.Next.Free = mtr.Value().(int64)
+			m.Next.Free = val
 			m.Next.SetFree = true
 		case `/sys/memory/inactive`:
-			m.Next.InActive = mtr.Value().(int64)
+			m.Next.InActive = val
 			m.Next.SetInActive = true
 		case `/sys/memory/swapfree`:
-			m.Next.SwapFree = mtr.Value().(int64)
+			m.Next.SwapFree = val
 			m.Next.SetSwapFree = true
 		case `/sys/memory/swaptotal`:
-			m.Next.SwapTotal = mtr.Value().(int64)
+			m.Next.SwapTotal = val
 			m.Next.SetSwapTotal = true
 		case `/sys/memory/total`:
-			m.Next.Total = mtr.Value().(int64)
+			m.Next.Total = val
 			m.Next.SetTotal = true
 		}
-		return
+		return nil
 	}
 
 	// out of order metric for old timestamp
 	if m.NextTime.After(mtr.TS) {
-		return
+		return nil
 	}
 
 	// abandon current next and start new one
@@ -99,6 +105,7 @@ processing:
 		m.Next = distribution{}
 		goto processing
 	}
+	return nil
 }
 
 // Calculate checks if the next distribution has been fully assembled
@@ -0,0 +1,82 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+// Package numeric provides checked access to the value of metrics.
+// Agents do not always send a metric with the type cyclone expects,
+// for example a counter as real. Instead of panicking on a failed type
+// assertion, numeric values are coerced and everything else is
+// rejected with an error.
+package numeric // import "github.com/mjolnir42/cyclone/lib/cyclone/numeric"
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/mjolnir42/legacy"
+)
+
+// Int64 returns the value of m as int64. Floating point values are
+// accepted if they are integral and within range.
+func Int64(m *legacy.MetricSplit) (int64, error) {
+	switch v := m.Value().(type) {
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case uint64:
+		if v > math.MaxInt64 {
+			return 0, invalid(m, `out of range`)
+		}
+		return int64(v), nil
+	case float64:
+		switch {
+		case math.IsNaN(v), math.IsInf(v, 0):
+			return 0, invalid(m, `not finite`)
+		case v != math.Trunc(v):
+			return 0, invalid(m, `not integral`)
+		case v < math.MinInt64, v >= math.MaxInt64:
+			return 0, invalid(m, `out of range`)
+		}
+		return int64(v), nil
+	}
+	return 0, invalid(m, `not numeric`)
+}
+
+// Float64 returns the value of m as float64
+func Float64(m *legacy.MetricSplit) (float64, error) {
+	switch v := m.Value().(type) {
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return 0, invalid(m, `not finite`)
+		}
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case uint32:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	}
+	return 0, invalid(m, `not numeric`)
+}
+
+// invalid returns the error for the value of m
+func invalid(m *legacy.MetricSplit, reason string) error {
+	return fmt.Errorf("Invalid value %v (%T) of type %s for %s from %d: %s",
+		m.Value(), m.Value(), m.Type, m.Path, m.AssetID, reason)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
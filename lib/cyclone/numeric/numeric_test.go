@@ -0,0 +1,113 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package numeric // import "github.com/mjolnir42/cyclone/lib/cyclone/numeric"
+
+import (
+	"math"
+	"testing"
+
+	"github.com/mjolnir42/legacy"
+)
+
+func intMetric(v int64) *legacy.MetricSplit {
+	return &legacy.MetricSplit{
+		Path: `/test/metric`,
+		Type: `integer`,
+		Val:  legacy.MetricValue{IntVal: v},
+	}
+}
+
+func realMetric(v float64) *legacy.MetricSplit {
+	return &legacy.MetricSplit{
+		Path: `/test/metric`,
+		Type: `real`,
+		Val:  legacy.MetricValue{FlpVal: v},
+	}
+}
+
+func stringMetric(v string) *legacy.MetricSplit {
+	return &legacy.MetricSplit{
+		Path: `/test/metric`,
+		Type: `string`,
+		Val:  legacy.MetricValue{StrVal: v},
+	}
+}
+
+func TestInt64(t *testing.T) {
+	tests := []struct {
+		name  string
+		m     *legacy.MetricSplit
+		want  int64
+		valid bool
+	}{
+		{`integer`, intMetric(42), 42, true},
+		{`negative integer`, intMetric(-42), -42, true},
+		{`max integer`, intMetric(math.MaxInt64), math.MaxInt64, true},
+		{`integral real`, realMetric(42), 42, true},
+		{`negative integral real`, realMetric(-42), -42, true},
+		{`min integral real`, realMetric(math.MinInt64), math.MinInt64, true},
+		{`fractional real`, realMetric(42.5), 0, false},
+		{`NaN`, realMetric(math.NaN()), 0, false},
+		{`positive Inf`, realMetric(math.Inf(1)), 0, false},
+		{`negative Inf`, realMetric(math.Inf(-1)), 0, false},
+		{`real above range`, realMetric(math.MaxInt64), 0, false},
+		{`real below range`, realMetric(-1e19), 0, false},
+		{`string`, stringMetric(`42`), 0, false},
+		{`empty string`, stringMetric(``), 0, false},
+		{`unknown type`, &legacy.MetricSplit{Type: `bool`}, 0, false},
+	}
+
+	for _, tt := range tests {
+		got, err := Int64(tt.m)
+		switch {
+		case tt.valid && err != nil:
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+		case !tt.valid && err == nil:
+			t.Errorf("%s: expected error, got %d", tt.name, got)
+		case got != tt.want:
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFloat64(t *testing.T) {
+	tests := []struct {
+		name  string
+		m     *legacy.MetricSplit
+		want  float64
+		valid bool
+	}{
+		{`real`, realMetric(42.5), 42.5, true},
+		{`negative real`, realMetric(-42.5), -42.5, true},
+		{`max real`, realMetric(math.MaxFloat64), math.MaxFloat64, true},
+		{`integer`, intMetric(42), 42, true},
+		{`negative integer`, intMetric(-42), -42, true},
+		{`max integer`, intMetric(math.MaxInt64), math.MaxInt64, true},
+		{`NaN`, realMetric(math.NaN()), 0, false},
+		{`positive Inf`, realMetric(math.Inf(1)), 0, false},
+		{`negative Inf`, realMetric(math.Inf(-1)), 0, false},
+		{`string`, stringMetric(`42.5`), 0, false},
+		{`empty string`, stringMetric(``), 0, false},
+		{`unknown type`, &legacy.MetricSplit{Type: `bool`}, 0, false},
+	}
+
+	for _, tt := range tests {
+		got, err := Float64(tt.m)
+		switch {
+		case tt.valid && err != nil:
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+		case !tt.valid && err == nil:
+			t.Errorf("%s: expected error, got %g", tt.name, got)
+		case got != tt.want:
+			t.Errorf("%s: got %g, want %g", tt.name, got, tt.want)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
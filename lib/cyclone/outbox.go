@@ -0,0 +1,529 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/go-redis/redis"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// alarmEnvelope wraps an AlarmEvent with its delivery state inside the
+// outbox. Envelopes without Sink have not yet been distributed to the
+// alarm sinks. Previous is the level alerted before Alarm, by which
+// clears are routed.
+type alarmEnvelope struct {
+	ID       string     `json:"id"`
+	Sink     string     `json:"sink,omitempty"`
+	Metric   string     `json:"metric"`
+	Alarm    AlarmEvent `json:"alarm"`
+	Previous int64      `json:"previous_level,omitempty"`
+	Attempts int        `json:"attempts"`
+	Enqueued time.Time  `json:"enqueued"`
+	LastErr  string     `json:"last_error,omitempty"`
+	// member is the outbox entry the envelope was claimed as
+	member string
+}
+
+// outboxLease is the time a claimed alarm may take to be delivered,
+// requeued or buried before it is returned to the outbox for another
+// delivery attempt
+const outboxLease = 5 * time.Minute
+
+// destinationTimeout is the time SetDestination waits for the outbox
+// to pick up a change of the alarm destination
+const destinationTimeout = 10 * time.Second
+
+// destinationChange is a request to change the URI of the default
+// alarm sink, the result is sent to done
+type destinationChange struct {
+	uri  string
+	done chan error
+}
+
+// Outbox delivers the alarms queued by the Cyclone handlers to the
+// configured alarm sinks with retries and exponential backoff. Alarms
+// are collected into batches per sink that are sent with a bounded
+// number of concurrent requests. Alarms are only removed from the
+// outbox once they have been delivered or moved to the dead letter
+// storage, delivery is at least once.
+type Outbox struct {
+	Shutdown       chan struct{}
+	death          chan error
+	conf           *Config
+	metrics        *metrics.Registry
+	redis          *redis.Client
+	store          outboxStore
+	sinks          []AlarmSink
+	routes         []alarmRoute
+	breakers       map[string]*Breaker
+	queued         chan struct{}
+	destination    chan destinationChange
+	inflight       chan struct{}
+	wg             sync.WaitGroup
+	backoffInitial time.Duration
+	backoffMax     time.Duration
+	maxAge         time.Duration
+	batchSize      int
+	batchWait      time.Duration
+}
+
+// NewOutbox returns a new Outbox for configuration conf
+func NewOutbox(conf *Config, reg *metrics.Registry, death chan error) *Outbox {
+	o := &Outbox{
+		Shutdown:    make(chan struct{}),
+		death:       death,
+		conf:        conf,
+		metrics:     reg,
+		destination: make(chan destinationChange, 1),
+	}
+	o.backoffInitial = time.Duration(conf.Cyclone.AlarmBackoffInitial) * time.Millisecond
+	if o.backoffInitial == 0 {
+		o.backoffInitial = time.Second
+	}
+	o.backoffMax = time.Duration(conf.Cyclone.AlarmBackoffMax) * time.Millisecond
+	if o.backoffMax == 0 {
+		o.backoffMax = 5 * time.Minute
+	}
+	o.maxAge = time.Duration(conf.Cyclone.AlarmMaxAge) * time.Minute
+	if o.maxAge == 0 {
+		o.maxAge = time.Hour
+	}
+	o.batchSize = conf.Cyclone.AlarmBatchSize
+	if o.batchSize <= 0 {
+		o.batchSize = 32
+	}
+	o.batchWait = time.Duration(conf.Cyclone.AlarmBatchWait) * time.Millisecond
+	if o.batchWait == 0 {
+		o.batchWait = 250 * time.Millisecond
+	}
+	concurrency := conf.Cyclone.AlarmConcurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	o.queued = make(chan struct{}, o.batchSize)
+	o.inflight = make(chan struct{}, concurrency)
+
+	// without redis the outbox is kept in memory
+	switch conf.Redis.Connect {
+	case ``:
+		o.store = newMemOutbox()
+	default:
+		o.redis = redis.NewClient(&redis.Options{
+			Addr:     conf.Redis.Connect,
+			Password: conf.Redis.Password,
+			DB:       int(conf.Redis.DB),
+		})
+		o.store = &redisOutbox{client: o.redis}
+	}
+	return o
+}
+
+// Notify informs the Outbox that a new alarm has been queued. It never
+// blocks.
+func (o *Outbox) Notify() {
+	if o == nil {
+		return
+	}
+	select {
+	case o.queued <- struct{}{}:
+	default:
+	}
+}
+
+// Run is the event loop of the Outbox
+func (o *Outbox) Run() {
+	if o.redis != nil {
+		if _, err := o.redis.Ping().Result(); err != nil {
+			o.death <- err
+			<-o.Shutdown
+			return
+		}
+		defer o.redis.Close()
+	}
+
+	var err error
+	if o.sinks, err = newAlarmSinks(o.conf); err != nil {
+		o.death <- err
+		<-o.Shutdown
+		return
+	}
+	defer closeAlarmSinks(o.sinks)
+	o.breakers = make(map[string]*Breaker)
+	for _, s := range o.sinks {
+		o.breakers[s.Name()] = NewBreaker(
+			fmt.Sprintf("alarming.%s", s.Name()),
+			o.conf.Cyclone.CircuitThreshold,
+			time.Duration(o.conf.Cyclone.CircuitCooldown)*time.Second,
+			o.metrics,
+		)
+	}
+	if o.routes, err = newAlarmRoutes(o.conf, o.sinks); err != nil {
+		o.death <- err
+		<-o.Shutdown
+		return
+	}
+	if len(o.sinks) == 0 {
+		logrus.Warnln(`Outbox, No alarm sinks configured, alarms will be discarded`)
+	}
+
+	// alarms claimed by a previous run that died during delivery
+	o.expire()
+
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	// pending counts the alarms queued since the last flush, window
+	// fires once the oldest of them waited for batchWait
+	pending := 0
+	var window <-chan time.Time
+
+runloop:
+	for {
+		select {
+		case <-o.Shutdown:
+			break runloop
+		case <-o.queued:
+			pending++
+			if pending == 1 {
+				window = time.After(o.batchWait)
+			}
+			if pending < o.batchSize {
+				continue runloop
+			}
+			pending, window = 0, nil
+			o.flush()
+		case <-window:
+			pending, window = 0, nil
+			o.flush()
+		case <-tick.C:
+			// pick up alarms that are due for retry or whose
+			// delivery lease expired
+			o.expire()
+			o.flush()
+			o.updateDepth()
+		case c := <-o.destination:
+			c.done <- o.setDestination(c.uri)
+		}
+	}
+	// wait for running deliveries before the store is closed
+	o.wg.Wait()
+}
+
+// SetDestination changes the URI of the default alarm sink, which is
+// configured by alarming.destination. It returns once the outbox
+// applied or refused the change. Changes the outbox does not pick up
+// within destinationTimeout are withdrawn and reported as error.
+func (o *Outbox) SetDestination(uri string) error {
+	c := destinationChange{uri: uri, done: make(chan error, 1)}
+	select {
+	case o.destination <- c:
+	default:
+		return fmt.Errorf("Previous alarm destination change still pending, ignoring %s", uri)
+	}
+
+	select {
+	case err := <-c.done:
+		return err
+	case <-time.After(destinationTimeout):
+	}
+	select {
+	case <-o.destination:
+		return fmt.Errorf("Outbox did not pick up the alarm destination change to %s within %s",
+			uri, destinationTimeout)
+	case err := <-c.done:
+		return err
+	}
+}
+
+// setDestination implements SetDestination inside the Run loop
+func (o *Outbox) setDestination(uri string) error {
+	for _, s := range o.sinks {
+		if h, ok := s.(*httpSink); ok && h.Name() == `default` {
+			if err := h.setURI(uri); err != nil {
+				return err
+			}
+			logrus.Infof("Outbox, Changed alarm destination to %s", uri)
+			return nil
+		}
+	}
+	return fmt.Errorf("No default sink to change the alarm destination to %s", uri)
+}
+
+// flush sends all alarms in the outbox that are due for delivery. It
+// claims batches until a round claims less than batchSize entries.
+func (o *Outbox) flush() {
+	for {
+		batches, claimed := o.claim()
+		for sink, batch := range batches {
+			// blocks while the maximum number of requests is in flight
+			o.inflight <- struct{}{}
+			o.wg.Add(1)
+			go func(s AlarmSink, b []alarmEnvelope) {
+				defer func() {
+					<-o.inflight
+					o.wg.Done()
+				}()
+				o.deliver(s, b)
+			}(sink, batch)
+		}
+		if claimed < o.batchSize {
+			return
+		}
+	}
+}
+
+// claim leases up to batchSize alarms that are due for delivery from
+// the outbox and returns them grouped by alarm sink, together with the
+// number of outbox entries it claimed. Alarms that have not yet been
+// distributed are replaced by one entry per alarm sink. A storage
+// error ends the round with the alarms claimed so far.
+func (o *Outbox) claim() (map[AlarmSink][]alarmEnvelope, int) {
+	now := time.Now().UTC()
+	due, err := o.store.due(now, o.batchSize)
+	if err != nil {
+		logrus.Errorf("Outbox, ERROR reading queued alarms: %s", err)
+		return nil, 0
+	}
+	lease := now.Add(outboxLease)
+
+	batches := make(map[AlarmSink][]alarmEnvelope)
+	claimed := 0
+	for _, member := range due {
+		// claim the entry before delivery, it may have been claimed
+		// by another process
+		ok, err := o.store.claim(member, lease)
+		if err != nil {
+			logrus.Errorf("Outbox, ERROR claiming queued alarm: %s", err)
+			break
+		}
+		if !ok {
+			continue
+		}
+		claimed++
+		e := alarmEnvelope{}
+		if err := json.Unmarshal([]byte(member), &e); err != nil {
+			logrus.Errorf("Outbox, ERROR decoding queued alarm: %s", err)
+			o.bury(member, member)
+			continue
+		}
+		e.member = member
+
+		// retried alarms are only delivered to the sink that failed
+		if e.Sink != `` {
+			if s := o.sink(e.Sink); s != nil {
+				batches[s] = append(batches[s], e)
+				continue
+			}
+			logrus.Errorf("Outbox, Burying alarm for %s queued for unknown sink %s", e.Alarm.EventID, e.Sink)
+			o.bury(member, member)
+			continue
+		}
+
+		sinks := o.destinations(&e)
+		if len(sinks) == 0 {
+			o.filtered(&e)
+			continue
+		}
+		// targets[i] receives parts[i]
+		targets := make([]AlarmSink, 0, len(sinks))
+		parts := make([]alarmEnvelope, 0, len(sinks))
+		members := make([]string, 0, len(sinks))
+		for _, s := range sinks {
+			se := e
+			se.Sink = s.Name()
+			buf, err := json.Marshal(&se)
+			if err != nil {
+				logrus.Errorf("Outbox, ERROR encoding alarm for %s: %s", e.Alarm.EventID, err)
+				continue
+			}
+			se.member = string(buf)
+			targets = append(targets, s)
+			parts = append(parts, se)
+			members = append(members, se.member)
+		}
+		// the entry is retried once its lease expires if the
+		// distribution can not be stored
+		if err := o.store.fanout(member, members, lease); err != nil {
+			logrus.Errorf("Outbox, ERROR distributing alarm for %s: %s", e.Alarm.EventID, err)
+			continue
+		}
+		for i, s := range targets {
+			batches[s] = append(batches[s], parts[i])
+		}
+	}
+	return batches, claimed
+}
+
+// filtered removes the claimed alarm e that no alarm sink accepts.
+// Routes always select a sink, so e was dropped by the sink filters or
+// no sinks are configured at all.
+func (o *Outbox) filtered(e *alarmEnvelope) {
+	metrics.GetOrRegisterMeter(`/alarms/filtered.per.second`,
+		*o.metrics).Mark(1)
+	logrus.Debugf("Outbox, No alarm sink accepts alarm for %s from %s", e.Alarm.EventID, e.Metric)
+	if err := o.store.ack(e.member); err != nil {
+		logrus.Errorf("Outbox, ERROR removing filtered alarm for %s: %s", e.Alarm.EventID, err)
+	}
+}
+
+// expire returns alarms whose delivery lease expired to the outbox
+func (o *Outbox) expire() {
+	total := 0
+	for {
+		n, err := o.store.expire(time.Now().UTC(), o.batchSize)
+		if err != nil {
+			logrus.Errorf("Outbox, ERROR requeueing alarms with expired lease: %s", err)
+			return
+		}
+		total += n
+		if n < o.batchSize {
+			break
+		}
+	}
+	if total > 0 {
+		logrus.Warnf("Outbox, Requeued %d alarms with expired delivery lease", total)
+	}
+}
+
+// sink returns the alarm sink with the given name or nil
+func (o *Outbox) sink(name string) AlarmSink {
+	for _, s := range o.sinks {
+		if s.Name() == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// deliver sends batch to sink and schedules retries if that fails.
+// While the circuit of sink is open, the batch is requeued without
+// attempting delivery.
+func (o *Outbox) deliver(sink AlarmSink, batch []alarmEnvelope) {
+	breaker := o.breakers[sink.Name()]
+	if !breaker.Allow() {
+		err := fmt.Errorf("Circuit open for sink %s", sink.Name())
+		for i := range batch {
+			o.retry(&batch[i], err)
+		}
+		return
+	}
+
+	alarms := make([]AlarmEvent, len(batch))
+	for i := range batch {
+		alarms[i] = batch[i].Alarm
+	}
+	start := time.Now()
+	err := sink.Send(alarms)
+	metrics.GetOrRegisterTimer(`/alarms/delivery.duration`,
+		*o.metrics).UpdateSince(start)
+	if err != nil {
+		logrus.Errorf("Outbox, ERROR sending batch of %d alarms to %s: %s", len(alarms), sink.Name(), err)
+		breaker.Failure()
+		for i := range batch {
+			o.retry(&batch[i], err)
+		}
+		return
+	}
+	breaker.Success()
+	metrics.GetOrRegisterMeter(`/alarms/delivered.per.second`,
+		*o.metrics).Mark(int64(len(alarms)))
+	for i := range batch {
+		if err := o.store.ack(batch[i].member); err != nil {
+			logrus.Errorf("Outbox, ERROR removing delivered alarm for %s: %s", batch[i].Alarm.EventID, err)
+		}
+	}
+}
+
+// retry requeues e with exponential backoff or moves it to the dead
+// letter storage once it exceeded the maximum age
+func (o *Outbox) retry(e *alarmEnvelope, err error) {
+	e.Attempts++
+	e.LastErr = err.Error()
+	buf, jErr := json.Marshal(e)
+	if jErr != nil {
+		logrus.Errorf("Outbox, ERROR encoding alarm for %s: %s", e.Alarm.EventID, jErr)
+		return
+	}
+
+	if time.Now().UTC().Sub(e.Enqueued) > o.maxAge {
+		logrus.Errorf("Outbox, Giving up on alarm for %s after %d attempts", e.Alarm.EventID, e.Attempts)
+		o.bury(e.member, string(buf))
+		return
+	}
+
+	next := time.Now().UTC().Add(o.backoff(e.Attempts))
+	if sErr := o.store.requeue(e.member, string(buf), next); sErr != nil {
+		logrus.Errorf("Outbox, ERROR requeueing alarm for %s: %s", e.Alarm.EventID, sErr)
+		return
+	}
+	metrics.GetOrRegisterMeter(`/alarms/retries.per.second`,
+		*o.metrics).Mark(1)
+}
+
+// bury replaces the claimed entry old with member in the dead letter
+// storage
+func (o *Outbox) bury(old, member string) {
+	if err := o.store.bury(old, member); err != nil {
+		logrus.Errorf("Outbox, ERROR writing dead letter: %s", err)
+		return
+	}
+	metrics.GetOrRegisterMeter(`/alarms/deadletter.per.second`,
+		*o.metrics).Mark(1)
+}
+
+// backoff returns the delay before delivery attempt n+1
+func (o *Outbox) backoff(n int) time.Duration {
+	d := o.backoffInitial
+	for i := 1; i < n; i++ {
+		d *= 2
+		if d >= o.backoffMax {
+			return o.backoffMax
+		}
+	}
+	return d
+}
+
+// updateDepth exports the current size of the outbox and the dead
+// letter storage
+func (o *Outbox) updateDepth() {
+	queued, dead, err := o.store.depth()
+	if err != nil {
+		logrus.Errorf("Outbox, ERROR reading outbox depth: %s", err)
+		return
+	}
+	metrics.GetOrRegisterGauge(`/alarms/outbox.depth`,
+		*o.metrics).Update(queued)
+	metrics.GetOrRegisterGauge(`/alarms/deadletter.depth`,
+		*o.metrics).Update(dead)
+}
+
+// enqueueAlarm writes a for metric, which was raised after an alarm
+// of level previous, into the outbox for delivery
+func (c *Cyclone) enqueueAlarm(a AlarmEvent, previous int64, metric string) error {
+	now := time.Now().UTC()
+	buf, err := json.Marshal(&alarmEnvelope{
+		ID:       fmt.Sprintf("%d.%d", c.Num, now.UnixNano()),
+		Metric:   metric,
+		Alarm:    a,
+		Previous: previous,
+		Enqueued: now,
+	})
+	if err != nil {
+		return err
+	}
+	return c.Outbox.store.push(string(buf), now)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
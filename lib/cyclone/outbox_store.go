@@ -0,0 +1,298 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	// outboxKey is the redis sorted set holding queued alarms, scored
+	// by their next delivery attempt
+	outboxKey = `alarm.outbox`
+	// processingKey is the redis sorted set holding claimed alarms,
+	// scored by the expiry of their delivery lease
+	processingKey = `alarm.processing`
+	// deadletterKey is the redis list holding the newest
+	// undeliverable alarms
+	deadletterKey = `alarm.deadletter`
+	// deadletterSize is the number of undeliverable alarms kept
+	deadletterSize = 1024
+)
+
+var (
+	// claimScript moves ARGV[1] from the queue KEYS[1] to the
+	// processing set KEYS[2] with the lease ARGV[2] if it is still
+	// queued
+	claimScript = redis.NewScript(`
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 1 then
+	redis.call('ZADD', KEYS[2], ARGV[2], ARGV[1])
+	return 1
+end
+return 0`)
+	// expireScript moves up to ARGV[2] members of the processing set
+	// KEYS[1] with a lease expired at ARGV[1] back to the queue
+	// KEYS[2]
+	expireScript = redis.NewScript(`
+local members = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, member in ipairs(members) do
+	redis.call('ZREM', KEYS[1], member)
+	redis.call('ZADD', KEYS[2], ARGV[1], member)
+end
+return #members`)
+)
+
+// outboxStore is the storage for alarms queued in the Outbox. Claimed
+// alarms are held in a processing set until their delivery is
+// acknowledged, they are requeued or buried. Claimed alarms whose
+// lease expired, because the claiming process died, are returned to
+// the queue by expire.
+type outboxStore interface {
+	// push queues member for delivery at due
+	push(member string, due time.Time) error
+	// due returns up to n members that are due for delivery at now
+	due(now time.Time, n int) ([]string, error)
+	// claim moves member from the queue to the processing set until
+	// lease and reports if the caller owns it for delivery
+	claim(member string, lease time.Time) (bool, error)
+	// fanout replaces the claimed member with the claimed members
+	// parts, leased until lease
+	fanout(member string, parts []string, lease time.Time) error
+	// ack removes the claimed member after its delivery
+	ack(member string) error
+	// requeue replaces the claimed member old with member queued for
+	// delivery at due
+	requeue(old, member string, due time.Time) error
+	// bury replaces the claimed member old with member in the dead
+	// letter storage
+	bury(old, member string) error
+	// expire returns up to n claimed members whose lease expired at
+	// now to the queue and returns their number
+	expire(now time.Time, n int) (int, error)
+	// depth returns the number of queued, including claimed, and dead
+	// letter members
+	depth() (int64, int64, error)
+}
+
+// redisOutbox is the durable outboxStore inside redis
+type redisOutbox struct {
+	client *redis.Client
+}
+
+func (r *redisOutbox) push(member string, due time.Time) error {
+	return r.client.ZAdd(outboxKey, redis.Z{
+		Score:  float64(due.UnixNano()),
+		Member: member,
+	}).Err()
+}
+
+func (r *redisOutbox) due(now time.Time, n int) ([]string, error) {
+	return r.client.ZRangeByScore(outboxKey, redis.ZRangeBy{
+		Min:   `-inf`,
+		Max:   strconv.FormatInt(now.UnixNano(), 10),
+		Count: int64(n),
+	}).Result()
+}
+
+func (r *redisOutbox) claim(member string, lease time.Time) (bool, error) {
+	// another process may work on the same outbox
+	n, err := claimScript.Run(r.client,
+		[]string{outboxKey, processingKey},
+		member, lease.UnixNano(),
+	).Int64()
+	return n == 1, err
+}
+
+func (r *redisOutbox) fanout(member string, parts []string, lease time.Time) error {
+	_, err := r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, part := range parts {
+			pipe.ZAdd(processingKey, redis.Z{
+				Score:  float64(lease.UnixNano()),
+				Member: part,
+			})
+		}
+		pipe.ZRem(processingKey, member)
+		return nil
+	})
+	return err
+}
+
+func (r *redisOutbox) ack(member string) error {
+	return r.client.ZRem(processingKey, member).Err()
+}
+
+func (r *redisOutbox) requeue(old, member string, due time.Time) error {
+	_, err := r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZRem(processingKey, old)
+		pipe.ZAdd(outboxKey, redis.Z{
+			Score:  float64(due.UnixNano()),
+			Member: member,
+		})
+		return nil
+	})
+	return err
+}
+
+func (r *redisOutbox) bury(old, member string) error {
+	_, err := r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZRem(processingKey, old)
+		pipe.LPush(deadletterKey, member)
+		pipe.LTrim(deadletterKey, 0, deadletterSize-1)
+		return nil
+	})
+	return err
+}
+
+func (r *redisOutbox) expire(now time.Time, n int) (int, error) {
+	return expireScript.Run(r.client,
+		[]string{processingKey, outboxKey},
+		now.UnixNano(), n,
+	).Int()
+}
+
+func (r *redisOutbox) depth() (int64, int64, error) {
+	queued, err := r.client.ZCard(outboxKey).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	claimed, err := r.client.ZCard(processingKey).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	dead, err := r.client.LLen(deadletterKey).Result()
+	return queued + claimed, dead, err
+}
+
+// memOutbox is the in-memory outboxStore used without redis. Queued
+// alarms are lost on restart.
+type memOutbox struct {
+	lock       sync.Mutex
+	queue      map[string]time.Time
+	processing map[string]time.Time
+	dead       []string
+}
+
+func newMemOutbox() *memOutbox {
+	return &memOutbox{
+		queue:      make(map[string]time.Time),
+		processing: make(map[string]time.Time),
+	}
+}
+
+func (m *memOutbox) push(member string, due time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.queue[member] = due
+	return nil
+}
+
+func (m *memOutbox) due(now time.Time, n int) ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	res := []string{}
+	for member, due := range m.queue {
+		if !due.After(now) {
+			res = append(res, member)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return m.queue[res[i]].Before(m.queue[res[j]])
+	})
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res, nil
+}
+
+func (m *memOutbox) claim(member string, lease time.Time) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.queue[member]; !ok {
+		return false, nil
+	}
+	delete(m.queue, member)
+	m.processing[member] = lease
+	return true, nil
+}
+
+func (m *memOutbox) fanout(member string, parts []string, lease time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, part := range parts {
+		m.processing[part] = lease
+	}
+	delete(m.processing, member)
+	return nil
+}
+
+func (m *memOutbox) ack(member string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.processing, member)
+	return nil
+}
+
+func (m *memOutbox) requeue(old, member string, due time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.processing, old)
+	m.queue[member] = due
+	return nil
+}
+
+func (m *memOutbox) bury(old, member string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.processing, old)
+	m.dead = append(m.dead, member)
+	if len(m.dead) > deadletterSize {
+		m.dead = m.dead[len(m.dead)-deadletterSize:]
+	}
+	return nil
+}
+
+func (m *memOutbox) expire(now time.Time, n int) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	count := 0
+	for member, lease := range m.processing {
+		if count == n {
+			break
+		}
+		if lease.After(now) {
+			continue
+		}
+		delete(m.processing, member)
+		m.queue[member] = now
+		count++
+	}
+	return count, nil
+}
+
+func (m *memOutbox) depth() (int64, int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return int64(len(m.queue) + len(m.processing)), int64(len(m.dead)), nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
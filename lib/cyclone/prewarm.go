@@ -0,0 +1,115 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/go-redis/redis"
+)
+
+// Prewarm bulk loads all configurations from provider into cache and,
+// if configured, into redis. Prewarm returns an error if loading did
+// not finish within the configured prewarm timeout, in which case
+// loading continues in the background.
+func Prewarm(conf *Config, cache *ThresholdCache, provider ThresholdProvider) error {
+	timeout := time.Duration(conf.Cyclone.PrewarmTimeout) * time.Second
+	if timeout == 0 {
+		timeout = 60 * time.Second
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- prewarm(conf, cache, provider)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("Prewarm did not finish within %s", timeout)
+	}
+}
+
+// prewarm implements Prewarm. Thresholds of lookups that are
+// invalidated while prewarming are discarded. At most cache size
+// lookups are loaded into cache, redis receives all of them.
+func prewarm(conf *Config, cache *ThresholdCache, provider ThresholdProvider) error {
+	token := cache.Token()
+	dat, err := provider.FetchAll()
+	if err != nil {
+		return err
+	}
+
+	// group configurations by the LookupID of the metrics they apply to
+	lookups := make(map[string]map[string]Thresh)
+	for _, i := range dat.Configurations {
+		lookup := lookupID(&i)
+		if _, ok := lookups[lookup]; !ok {
+			lookups[lookup] = make(map[string]Thresh)
+		}
+		lookups[lookup][i.ConfigurationItemID] = newThresh(&i)
+	}
+
+	var r *redis.Client
+	if conf.Redis.Connect != `` {
+		r = redis.NewClient(&redis.Options{
+			Addr:     conf.Redis.Connect,
+			Password: conf.Redis.Password,
+			DB:       int(conf.Redis.DB),
+		})
+		defer r.Close()
+
+		_, ttl := cache.TTL()
+		if _, err = r.Pipelined(func(p redis.Pipeliner) error {
+			for lookup, thr := range lookups {
+				p.Del(lookup)
+				for id := range thr {
+					t := thr[id]
+					if err := writeThreshold(p, lookup, &t, ttl); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	if cache != nil && len(lookups) > cache.Size() {
+		logrus.Warnf("Prewarm, %d lookups exceed cache.size %d, loading only %d into the cache",
+			len(lookups), cache.Size(), cache.Size())
+	}
+	now := time.Now().UTC()
+	invalidated := []string{}
+	cached := 0
+	for lookup, thr := range lookups {
+		if cache != nil && cached == cache.Size() {
+			break
+		}
+		if !cache.Set(lookup, thr, now, token) {
+			invalidated = append(invalidated, lookup)
+			continue
+		}
+		cached++
+	}
+	if r != nil && len(invalidated) > 0 {
+		if err = r.Del(invalidated...).Err(); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Prewarmed %d configurations for %d lookups, cached %d lookups, discarded %d invalidated lookups",
+		len(dat.Configurations), len(lookups)-len(invalidated),
+		cached, len(invalidated))
+	return nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,195 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+var (
+	// promHandler matches the handler number segment in metric names
+	promHandler = regexp.MustCompile(`/handler/([0-9]+)/`)
+	// promInvalid matches characters not allowed in Prometheus names
+	promInvalid = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+)
+
+// promFamily is a Prometheus metric family in text exposition format
+type promFamily struct {
+	kind    string
+	samples []string
+}
+
+// promExposition collects metric families for the text exposition
+type promExposition struct {
+	families map[string]*promFamily
+	labels   string
+}
+
+// add appends a sample with value v to the family name of type kind.
+// The sample has the exposition labels, the labels in extra and the
+// name suffix.
+func (p *promExposition) add(name, kind, suffix, extra string, v float64) {
+	f, ok := p.families[name]
+	if !ok {
+		f = &promFamily{kind: kind}
+		p.families[name] = f
+	}
+	labels := p.labels
+	switch {
+	case labels == ``:
+		labels = extra
+	case extra != ``:
+		labels = labels + `,` + extra
+	}
+	if labels != `` {
+		labels = `{` + labels + `}`
+	}
+	f.samples = append(f.samples, fmt.Sprintf("%s%s%s %s",
+		name, suffix, labels,
+		strconv.FormatFloat(v, 'g', -1, 64)))
+}
+
+// write outputs all families sorted by name
+func (p *promExposition) write(buf *bytes.Buffer) {
+	names := make([]string, 0, len(p.families))
+	for name := range p.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(buf, "# TYPE %s %s\n", name, p.families[name].kind)
+		for _, s := range p.families[name].samples {
+			buf.WriteString(s)
+			buf.WriteByte('\n')
+		}
+	}
+}
+
+// promName converts the go-metrics name metric below prefix into a
+// Prometheus name and the handler label, if the name contains one
+func promName(prefix, metric string) (string, string) {
+	metric = strings.TrimPrefix(metric, prefix)
+	handler := ``
+	if m := promHandler.FindStringSubmatch(metric); m != nil {
+		handler = fmt.Sprintf("handler=%q", m[1])
+		metric = promHandler.ReplaceAllString(metric, `/handler/`)
+	}
+	metric = strings.TrimSuffix(metric, `.per.second`)
+	name := strings.Trim(promInvalid.ReplaceAllString(metric, `_`), `_`)
+	return `cyclone_` + name, handler
+}
+
+// promQuantiles are the quantiles exported for histograms and timers
+var promQuantiles = []float64{0.5, 0.95, 0.99}
+
+// exportPrometheus adds all metrics in reg below prefix to p
+func exportPrometheus(p *promExposition, reg metrics.Registry, prefix string) {
+	reg.Each(func(metric string, v interface{}) {
+		name, handler := promName(prefix, metric)
+		switch m := v.(type) {
+		case metrics.Counter:
+			p.add(name+`_total`, `counter`, ``, handler, float64(m.Count()))
+		case metrics.Gauge:
+			p.add(name, `gauge`, ``, handler, float64(m.Value()))
+		case metrics.GaugeFloat64:
+			p.add(name, `gauge`, ``, handler, m.Value())
+		case metrics.Meter:
+			s := m.Snapshot()
+			p.add(name+`_total`, `counter`, ``, handler, float64(s.Count()))
+			p.add(name+`_rate1m`, `gauge`, ``, handler, s.Rate1())
+		case metrics.Histogram:
+			s := m.Snapshot()
+			ps := s.Percentiles(promQuantiles)
+			for i, q := range promQuantiles {
+				p.add(name, `summary`, ``, joinLabels(handler,
+					fmt.Sprintf("quantile=%q", strconv.FormatFloat(q, 'g', -1, 64))),
+					ps[i])
+			}
+			p.add(name, `summary`, `_sum`, handler, float64(s.Sum()))
+			p.add(name, `summary`, `_count`, handler, float64(s.Count()))
+		case metrics.Timer:
+			s := m.Snapshot()
+			ps := s.Percentiles(promQuantiles)
+			name = name + `_seconds`
+			for i, q := range promQuantiles {
+				p.add(name, `summary`, ``, joinLabels(handler,
+					fmt.Sprintf("quantile=%q", strconv.FormatFloat(q, 'g', -1, 64))),
+					ps[i]/float64(time.Second))
+			}
+			p.add(name, `summary`, `_sum`, handler,
+				float64(s.Sum())/float64(time.Second))
+			p.add(name, `summary`, `_count`, handler, float64(s.Count()))
+		}
+	})
+}
+
+// exportRuntime adds the Go runtime metrics to p
+func exportRuntime(p *promExposition) {
+	ms := runtime.MemStats{}
+	runtime.ReadMemStats(&ms)
+
+	p.add(`go_goroutines`, `gauge`, ``, ``, float64(runtime.NumGoroutine()))
+	p.add(`go_memstats_alloc_bytes`, `gauge`, ``, ``, float64(ms.Alloc))
+	p.add(`go_memstats_alloc_bytes_total`, `counter`, ``, ``, float64(ms.TotalAlloc))
+	p.add(`go_memstats_sys_bytes`, `gauge`, ``, ``, float64(ms.Sys))
+	p.add(`go_memstats_heap_inuse_bytes`, `gauge`, ``, ``, float64(ms.HeapInuse))
+	p.add(`go_memstats_heap_objects`, `gauge`, ``, ``, float64(ms.HeapObjects))
+	p.add(`go_memstats_mallocs_total`, `counter`, ``, ``, float64(ms.Mallocs))
+	p.add(`go_memstats_frees_total`, `counter`, ``, ``, float64(ms.Frees))
+	p.add(`go_gc_runs_total`, `counter`, ``, ``, float64(ms.NumGC))
+	p.add(`go_gc_pause_seconds_total`, `counter`, ``, ``,
+		float64(ms.PauseTotalNs)/float64(time.Second))
+	p.add(`go_info`, `gauge`, ``, fmt.Sprintf("version=%q", runtime.Version()), 1)
+}
+
+// joinLabels joins the non-empty label pairs in labels
+func joinLabels(labels ...string) string {
+	res := []string{}
+	for _, l := range labels {
+		if l != `` {
+			res = append(res, l)
+		}
+	}
+	return strings.Join(res, `,`)
+}
+
+// prometheus serves the metrics registry and the Go runtime metrics
+// in the Prometheus text exposition format
+func (a *Admin) prometheus(w http.ResponseWriter, r *http.Request,
+	_ httprouter.Params) {
+	p := &promExposition{
+		families: make(map[string]*promFamily),
+	}
+	prefix := `/cyclone`
+	if a.conf.Misc.InstanceName != `` {
+		prefix = fmt.Sprintf("/cyclone/%s", a.conf.Misc.InstanceName)
+		p.labels = fmt.Sprintf("instance=%q", a.conf.Misc.InstanceName)
+	}
+	exportPrometheus(p, *a.metrics, prefix)
+	exportRuntime(p)
+
+	buf := &bytes.Buffer{}
+	p.write(buf)
+	w.Header().Set(`Content-Type`, `text/plain; version=0.0.4`)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,83 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mjolnir42/legacy"
+)
+
+// probeInterval is the minimum interval between two reachability
+// checks of a ThresholdProvider
+var probeInterval = 10 * time.Second
+
+// ThresholdProvider is the source of threshold configurations. It is
+// shared by all handlers.
+type ThresholdProvider interface {
+	// Fetch returns the configurations for a LookupID
+	Fetch(lookup string) (*ConfigurationData, error)
+	// FetchAll returns all configurations
+	FetchAll() (*ConfigurationData, error)
+	// Probe checks if the provider is able to serve configurations.
+	// It is cheap and performs at most one check per probeInterval.
+	Probe() error
+	// Run performs background work until the provider is shut down
+	Run()
+	// ShutdownChannel returns the shutdown signal channel
+	ShutdownChannel() chan struct{}
+}
+
+// NewThresholdProvider returns the ThresholdProvider selected in
+// configuration conf. Providers that detect configuration changes by
+// themselves invalidate the affected entries in cache.
+func NewThresholdProvider(conf *Config, cache *ThresholdCache) (ThresholdProvider, error) {
+	switch conf.Cyclone.LookupProvider {
+	case ``, `eye`:
+		return newEyeProvider(conf)
+	case `file`:
+		return newFileProvider(conf, cache)
+	default:
+		return nil, fmt.Errorf("Unknown lookup provider: %s",
+			conf.Cyclone.LookupProvider)
+	}
+}
+
+// prober rate limits the reachability checks of a ThresholdProvider
+type prober struct {
+	lock    sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// probe returns the result of check, which is performed again only
+// once the previous result is older than probeInterval
+func (p *prober) probe(check func() error) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.checked.IsZero() && time.Since(p.checked) < probeInterval {
+		return p.err
+	}
+	p.err = check()
+	p.checked = time.Now()
+	return p.err
+}
+
+// lookupID returns the LookupID of the metrics that i applies to
+func lookupID(i *ConfigurationItem) string {
+	return (&legacy.MetricSplit{
+		AssetID: int64(i.HostID),
+		Path:    i.Metric,
+	}).LookupID()
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,228 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// eyeProvider is the ThresholdProvider querying the eye monitoring
+// profile lookup service
+type eyeProvider struct {
+	shutdown  chan struct{}
+	base      string
+	client    *http.Client
+	bulk      *http.Client
+	auth      httpAuth
+	retries   int
+	retryWait time.Duration
+	prober    prober
+}
+
+// newEyeProvider returns a new eyeProvider for configuration conf.
+// Bearer tokens and basic auth credentials are refused for lookup
+// URLs without TLS.
+func newEyeProvider(conf *Config) (*eyeProvider, error) {
+	if conf.Cyclone.InsecureLookup() {
+		return nil, fmt.Errorf("Refusing to send lookup credentials without TLS, lookup.url must be an https URL")
+	}
+	base, err := lookupBaseURL(conf)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newTLSConfig(
+		conf.Cyclone.LookupTLSCAFile,
+		conf.Cyclone.LookupTLSCertFile,
+		conf.Cyclone.LookupTLSKeyFile,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := time.Duration(conf.Cyclone.LookupTimeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = 2 * time.Second
+	}
+	bulkTimeout := time.Duration(conf.Cyclone.PrewarmTimeout) * time.Second
+	if bulkTimeout == 0 {
+		bulkTimeout = 60 * time.Second
+	}
+	retryWait := time.Duration(conf.Cyclone.LookupRetryWait) * time.Millisecond
+	if retryWait == 0 {
+		retryWait = 100 * time.Millisecond
+	}
+	return &eyeProvider{
+		shutdown: make(chan struct{}),
+		base:     base,
+		client:   newHTTPClient(tlsConfig, timeout),
+		bulk:     newHTTPClient(tlsConfig, bulkTimeout),
+		auth: httpAuth{
+			token:    conf.Cyclone.LookupAuthToken,
+			user:     conf.Cyclone.LookupAuthUser,
+			password: conf.Cyclone.LookupAuthPassword,
+		},
+		retries:   conf.Cyclone.LookupRetries,
+		retryWait: retryWait,
+	}, nil
+}
+
+// lookupBaseURL returns the base URL of the lookup service from
+// lookup.url or, if that is not set, from the lookup.host, lookup.port
+// and lookup.path settings
+func lookupBaseURL(conf *Config) (string, error) {
+	if conf.Cyclone.LookupURL == `` {
+		return fmt.Sprintf("http://%s:%s/%s",
+			conf.Cyclone.LookupHost,
+			conf.Cyclone.LookupPort,
+			strings.Trim(conf.Cyclone.LookupPath, `/`),
+		), nil
+	}
+	u, err := url.Parse(conf.Cyclone.LookupURL)
+	if err != nil {
+		return ``, err
+	}
+	if (u.Scheme != `http` && u.Scheme != `https`) || u.Host == `` {
+		return ``, fmt.Errorf("Invalid lookup.url: %s",
+			conf.Cyclone.LookupURL)
+	}
+	return strings.TrimRight(u.String(), `/`), nil
+}
+
+// Fetch queries the lookup service for all configurations matching a
+// legacy.MetricSplit.LookupID at <base URL>/<LookupID>. A LookupID
+// unknown to the lookup service has no configurations.
+func (e *eyeProvider) Fetch(lookup string) (*ConfigurationData, error) {
+	return e.get(e.client, e.base+`/`+url.PathEscape(lookup), false)
+}
+
+// FetchAll queries the lookup service for all configurations. The
+// lookup service must list them at the base URL as a JSON object with
+// the configurations attribute, in the same format as the response of
+// Fetch. Any other response, including 404, is an error.
+func (e *eyeProvider) FetchAll() (*ConfigurationData, error) {
+	return e.get(e.bulk, e.base, true)
+}
+
+// get requests the ConfigurationData at uri using client, for all
+// configurations if bulk is set. Failed requests and server errors are
+// retried with exponential backoff.
+func (e *eyeProvider) get(client *http.Client, uri string, bulk bool) (*ConfigurationData, error) {
+	wait := e.retryWait
+	for attempt := 0; ; attempt++ {
+		d, retry, err := e.request(client, uri, bulk)
+		if err == nil || !retry || attempt >= e.retries {
+			return d, err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// request performs a single request for the ConfigurationData at uri
+// using client and reports if a failure may be retried. A missing
+// resource has no configurations, unless bulk is set.
+func (e *eyeProvider) request(client *http.Client, uri string, bulk bool) (*ConfigurationData, bool, error) {
+	req, err := http.NewRequest(`GET`, uri, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	e.auth.apply(req, nil)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound && !bulk:
+		io.Copy(ioutil.Discard, resp.Body)
+		return &ConfigurationData{}, false, nil
+	case resp.StatusCode >= 500:
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, true, fmt.Errorf("Lookup service returned %d for %s",
+			resp.StatusCode, uri)
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, false, fmt.Errorf("Lookup service returned %d for %s",
+			resp.StatusCode, uri)
+	}
+
+	if !bulk {
+		d := &ConfigurationData{}
+		if err = json.NewDecoder(resp.Body).Decode(d); err != nil {
+			return nil, false, err
+		}
+		return d, false, nil
+	}
+
+	// a response without the configurations attribute is not a
+	// listing of all configurations
+	listing := struct {
+		Configurations *[]ConfigurationItem `json:"configurations"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&listing); err != nil {
+		return nil, false, err
+	}
+	if listing.Configurations == nil {
+		return nil, false, fmt.Errorf("Lookup service response for %s does not list configurations", uri)
+	}
+	return &ConfigurationData{
+		Configurations: *listing.Configurations,
+	}, false, nil
+}
+
+// Probe checks if the lookup service is reachable with a HEAD request
+// for the base URL, which does not transfer the listing of all
+// configurations. Server errors and rejected credentials fail the
+// check.
+func (e *eyeProvider) Probe() error {
+	return e.prober.probe(func() error {
+		req, err := http.NewRequest(`HEAD`, e.base, nil)
+		if err != nil {
+			return err
+		}
+		e.auth.apply(req, nil)
+
+		resp, err := e.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(ioutil.Discard, resp.Body)
+
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized,
+			resp.StatusCode == http.StatusForbidden,
+			resp.StatusCode >= 500:
+			return fmt.Errorf("Lookup service returned %d for %s",
+				resp.StatusCode, e.base)
+		}
+		return nil
+	})
+}
+
+// Run blocks until the provider is shut down
+func (e *eyeProvider) Run() {
+	<-e.shutdown
+}
+
+// ShutdownChannel returns the shutdown signal channel
+func (e *eyeProvider) ShutdownChannel() chan struct{} {
+	return e.shutdown
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,221 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/go-redis/redis"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// fileProviderInterval is the interval at which the fileProvider checks
+// its file for changes
+const fileProviderInterval = 10 * time.Second
+
+// fileProvider is the ThresholdProvider serving configurations from a
+// JSON or YAML file in the format of the lookup service. The file is
+// reloaded when its modification time changes.
+type fileProvider struct {
+	shutdown chan struct{}
+	conf     *Config
+	cache    *ThresholdCache
+	path     string
+	lock     sync.RWMutex
+	modified time.Time
+	data     *ConfigurationData
+	lookups  map[string][]ConfigurationItem
+	prober   prober
+}
+
+// newFileProvider returns a new fileProvider for configuration conf
+// that has loaded its file
+func newFileProvider(conf *Config, cache *ThresholdCache) (*fileProvider, error) {
+	if conf.Cyclone.LookupFile == `` {
+		return nil, fmt.Errorf(`File lookup provider requires lookup.file`)
+	}
+	f := &fileProvider{
+		shutdown: make(chan struct{}),
+		conf:     conf,
+		cache:    cache,
+		path:     conf.Cyclone.LookupFile,
+	}
+	if _, err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Fetch returns the configurations for lookup
+func (f *fileProvider) Fetch(lookup string) (*ConfigurationData, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return &ConfigurationData{
+		Configurations: f.lookups[lookup],
+	}, nil
+}
+
+// FetchAll returns all configurations
+func (f *fileProvider) FetchAll() (*ConfigurationData, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.data, nil
+}
+
+// Probe checks if the file is still accessible
+func (f *fileProvider) Probe() error {
+	return f.prober.probe(func() error {
+		_, err := os.Stat(f.path)
+		return err
+	})
+}
+
+// Run reloads the file on changes until the provider is shut down.
+// After a reload all LookupIDs in the previous and the new file are
+// invalidated.
+func (f *fileProvider) Run() {
+	var client *redis.Client
+	if f.conf.Redis.Connect != `` {
+		client = redis.NewClient(&redis.Options{
+			Addr:     f.conf.Redis.Connect,
+			Password: f.conf.Redis.Password,
+			DB:       int(f.conf.Redis.DB),
+		})
+		defer client.Close()
+	}
+
+	ticker := time.NewTicker(fileProviderInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.shutdown:
+			return
+		case <-ticker.C:
+			stat, err := os.Stat(f.path)
+			if err != nil {
+				logrus.Errorf("Provider, ERROR checking %s: %s", f.path, err)
+				continue
+			}
+			f.lock.RLock()
+			unchanged := stat.ModTime().Equal(f.modified)
+			f.lock.RUnlock()
+			if unchanged {
+				continue
+			}
+
+			changed, err := f.load()
+			if err != nil {
+				logrus.Errorf("Provider, ERROR reloading %s: %s", f.path, err)
+				continue
+			}
+			for _, lookup := range changed {
+				if _, err = invalidate(client, f.cache, &Invalidation{
+					LookupID: lookup,
+				}); err != nil {
+					logrus.Errorf("Provider, ERROR invalidating %s: %s", lookup, err)
+				}
+			}
+			logrus.Infof("Provider, Reloaded %s", f.path)
+		}
+	}
+}
+
+// load reads the file and returns the LookupIDs of the previous and
+// the new configurations
+func (f *fileProvider) load() ([]string, error) {
+	stat, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	data := &ConfigurationData{}
+	if err = decodeConfigurationData(f.path, buf, data); err != nil {
+		return nil, fmt.Errorf("Decoding %s: %s", f.path, err)
+	}
+	lookups := make(map[string][]ConfigurationItem)
+	for _, i := range data.Configurations {
+		lookup := lookupID(&i)
+		lookups[lookup] = append(lookups[lookup], i)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	changed := []string{}
+	for lookup := range f.lookups {
+		changed = append(changed, lookup)
+	}
+	for lookup := range lookups {
+		if _, ok := f.lookups[lookup]; !ok {
+			changed = append(changed, lookup)
+		}
+	}
+	f.modified = stat.ModTime()
+	f.data = data
+	f.lookups = lookups
+	return changed, nil
+}
+
+// decodeConfigurationData decodes buf read from path into data. Files
+// ending in .yaml or .yml are YAML, all other files are JSON. YAML is
+// converted to JSON first, so both formats use the attribute names of
+// the lookup service.
+func decodeConfigurationData(path string, buf []byte, data *ConfigurationData) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case `.yaml`, `.yml`:
+		var doc interface{}
+		if err := yaml.Unmarshal(buf, &doc); err != nil {
+			return err
+		}
+		var err error
+		if buf, err = json.Marshal(jsonValue(doc)); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(buf, data)
+}
+
+// jsonValue converts the mappings decoded by yaml.Unmarshal, which can
+// not be encoded as JSON, into maps with string keys
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[fmt.Sprint(key)] = jsonValue(val)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonValue(v[i])
+		}
+	}
+	return v
+}
+
+// ShutdownChannel returns the shutdown signal channel
+func (f *fileProvider) ShutdownChannel() chan struct{} {
+	return f.shutdown
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
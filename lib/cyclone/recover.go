@@ -0,0 +1,115 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mjolnir42/cyclone/lib/cyclone/cpu"
+	"github.com/mjolnir42/cyclone/lib/cyclone/disk"
+	"github.com/mjolnir42/cyclone/lib/cyclone/mem"
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+const (
+	// faultLimit is the number of panics within faultWindow after
+	// which a handler is restarted
+	faultLimit = 5
+	// faultWindow is the period over which panics are counted
+	faultWindow = time.Minute
+)
+
+// processSafely processes msg and recovers from panics. A message that
+// failed processing is logged and committed, so it is not consumed
+// again. A handler that panics repeatedly is restarted.
+func (c *Cyclone) processSafely(msg *erebos.Transport) {
+	panicked, err := c.recoverProcess(msg)
+	if err == nil {
+		return
+	}
+	logrus.Errorf("Cyclone[%d], ERROR processing message from %d: %s", c.Num, msg.HostID, err)
+	if msg.Commit != nil {
+		go c.commit(msg)
+	}
+	if !panicked || !c.fault() {
+		return
+	}
+	if err = c.restart(); err != nil {
+		// main closes Shutdown once it stops reading Death
+		select {
+		case c.Death <- err:
+		case <-c.Shutdown:
+		}
+	}
+}
+
+// recoverProcess runs process for msg, converts a panic into an error
+// and reports if process panicked
+func (c *Cyclone) recoverProcess(msg *erebos.Transport) (panicked bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			metrics.GetOrRegisterCounter(`/metrics/panics`,
+				*c.Metrics).Inc(1)
+			logrus.Errorf("Cyclone[%d], PANIC processing message %s: %v\n%s",
+				c.Num, string(msg.Value), r, debug.Stack())
+			panicked = true
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return false, c.process(msg)
+}
+
+// fault records a panic and reports if the handler exceeded faultLimit
+// within faultWindow
+func (c *Cyclone) fault() bool {
+	now := time.Now()
+	recent := c.faults[:0]
+	for _, t := range c.faults {
+		if now.Sub(t) < faultWindow {
+			recent = append(recent, t)
+		}
+	}
+	c.faults = append(recent, now)
+	return len(c.faults) >= faultLimit
+}
+
+// restart sets the handler up again with fresh state and alarm
+// templates, as on Start. The redis client is kept, it reconnects by
+// itself and is shared with background revalidations.
+func (c *Cyclone) restart() error {
+	logrus.Warnf("Cyclone[%d], Restarting handler after %d panics within %s", c.Num, len(c.faults), faultWindow)
+	metrics.GetOrRegisterCounter(`/handlers/restarts`,
+		*c.Metrics).Inc(1)
+
+	if err := c.setup(); err != nil {
+		return fmt.Errorf("Cyclone[%d], restart failed: %s", c.Num, err)
+	}
+	return nil
+}
+
+// resetState initializes the derived metric state and alarm levels
+func (c *Cyclone) resetState() {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	c.CPUData = make(map[int64]cpu.CPU)
+	c.MemData = make(map[int64]mem.Mem)
+	c.CTXData = make(map[int64]cpu.CTX)
+	c.DskData = make(map[int64]map[string]disk.Disk)
+	c.assetSeen = make(map[int64]time.Time)
+	c.mountSeen = make(map[int64]map[string]time.Time)
+	c.lastLevel = make(map[int64]map[string]int64)
+	c.firing = make(map[int64]map[string]FiringAlarm)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,125 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"fmt"
+	"path"
+)
+
+// alarmRoute selects the alarm sinks for all alarms matching it. Empty
+// match criteria match every alarm.
+type alarmRoute struct {
+	sinkFilter
+	name       string
+	metric     string
+	monitoring string
+	targethost string
+	sinks      []string
+}
+
+// newAlarmRoutes returns the routing table from conf. All routes must
+// refer to sinks contained in sinks. Unmatched alarms are sent to the
+// default sink, which is required unless a route matches all alarms.
+func newAlarmRoutes(conf *Config, sinks []AlarmSink) ([]alarmRoute, error) {
+	known := make(map[string]bool)
+	for _, s := range sinks {
+		known[s.Name()] = true
+	}
+
+	routes := []alarmRoute{}
+	catchAll := false
+	for _, r := range conf.Cyclone.AlarmRoutes {
+		catchAll = catchAll || r.MatchesAll()
+		f, err := newSinkFilter(r.Name, r.Levels, r.Teams)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := path.Match(r.Metric, ``); err != nil {
+			return nil, fmt.Errorf("Invalid metric pattern %s for route %s: %s",
+				r.Metric, r.Name, err)
+		}
+		for _, s := range r.Sinks {
+			if !known[s] {
+				return nil, fmt.Errorf("Route %s refers to unknown sink %s",
+					r.Name, s)
+			}
+		}
+		routes = append(routes, alarmRoute{
+			sinkFilter: f,
+			name:       r.Name,
+			metric:     r.Metric,
+			monitoring: r.Monitoring,
+			targethost: r.Targethost,
+			sinks:      r.Sinks,
+		})
+	}
+	if len(routes) > 0 && !known[`default`] && !catchAll {
+		return nil, fmt.Errorf("Alarm routes require alarming.destination or a route without match criteria for unmatched alarms")
+	}
+	return routes, nil
+}
+
+// matches reports if a for metric is routed by r
+func (r alarmRoute) matches(a AlarmEvent, metric string) bool {
+	if !r.Accepts(a) {
+		return false
+	}
+	if r.monitoring != `` && r.monitoring != a.Monitoring {
+		return false
+	}
+	if r.targethost != `` && r.targethost != a.Targethost {
+		return false
+	}
+	if r.metric != `` {
+		if ok, _ := path.Match(r.metric, metric); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// destinations returns the alarm sinks e has to be delivered to. The
+// first matching route selects the sinks. If no routes are configured
+// all sinks are selected, unmatched alarms are sent to the default
+// sink. In all cases the filters of the sinks apply. A clear is routed
+// and filtered by the level it clears, so it reaches the sinks that
+// received the alarm.
+func (o *Outbox) destinations(e *alarmEnvelope) []AlarmSink {
+	a := e.Alarm
+	if a.Level == 0 && e.Previous != 0 {
+		a.Level = e.Previous
+	}
+
+	var names []string
+	switch {
+	case len(o.routes) == 0:
+		for _, s := range o.sinks {
+			names = append(names, s.Name())
+		}
+	default:
+		names = []string{`default`}
+		for _, r := range o.routes {
+			if r.matches(a, e.Metric) {
+				names = r.sinks
+				break
+			}
+		}
+	}
+
+	res := []AlarmSink{}
+	for _, n := range names {
+		if s := o.sink(n); s != nil && s.Accepts(a) {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,54 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Settings are the configuration values that can be changed while
+// cyclone is running. They are replaced as a whole on reload.
+type Settings struct {
+	// AgeCutOff is the negative duration after which back-processed
+	// metrics are ignored and not alerted
+	AgeCutOff time.Duration
+	// TestMode disables sending out alarms
+	TestMode bool
+}
+
+// settings holds the active *Settings
+var settings atomic.Value
+
+func init() {
+	settings.Store(&Settings{})
+}
+
+// NewSettings returns the reloadable Settings from configuration conf
+func NewSettings(conf *Config) *Settings {
+	return &Settings{
+		AgeCutOff: time.Duration(
+			conf.Cyclone.MetricsMaxAge,
+		) * time.Minute * -1,
+		TestMode: conf.Cyclone.TestMode,
+	}
+}
+
+// ApplySettings atomically replaces the active settings of all
+// handlers with s
+func ApplySettings(s *Settings) {
+	settings.Store(s)
+}
+
+// currentSettings returns the active settings
+func currentSettings() *Settings {
+	return settings.Load().(*Settings)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
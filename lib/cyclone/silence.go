@@ -0,0 +1,179 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/go-redis/redis"
+)
+
+// silenceKey is the redis hash holding all silences by ID
+const silenceKey = `silences`
+
+// silenceRefresh is the interval after which a handler reloads the
+// silences from redis
+const silenceRefresh = 10 * time.Second
+
+// Silence suppresses all alarms that match it between StartsAt and
+// EndsAt. Empty match criteria match every alarm, but a silence must
+// specify at least one criterion.
+type Silence struct {
+	ID                  string    `json:"id"`
+	AssetID             int64     `json:"asset_id,omitempty"`
+	ConfigurationItemID string    `json:"configuration_item_id,omitempty"`
+	Metric              string    `json:"metric,omitempty"`
+	Team                string    `json:"team,omitempty"`
+	StartsAt            time.Time `json:"starts_at"`
+	EndsAt              time.Time `json:"ends_at"`
+	CreatedBy           string    `json:"created_by,omitempty"`
+	Comment             string    `json:"comment,omitempty"`
+}
+
+// Validate checks that s is a valid silence
+func (s *Silence) Validate() error {
+	if s.AssetID == 0 && s.ConfigurationItemID == `` &&
+		s.Metric == `` && s.Team == `` {
+		return fmt.Errorf(`Silence without match criteria`)
+	}
+	if _, err := path.Match(s.Metric, ``); err != nil {
+		return fmt.Errorf("Invalid metric pattern %s: %s", s.Metric, err)
+	}
+	if s.EndsAt.IsZero() {
+		return fmt.Errorf(`Silence without end time`)
+	}
+	if !s.EndsAt.After(s.StartsAt) {
+		return fmt.Errorf(`Silence ends before it starts`)
+	}
+	return nil
+}
+
+// Active reports if s is in effect at t
+func (s *Silence) Active(t time.Time) bool {
+	return !t.Before(s.StartsAt) && t.Before(s.EndsAt)
+}
+
+// Matches reports if s suppresses alarms for the evaluation of metric
+// from asset against configuration item id owned by team
+func (s *Silence) Matches(asset int64, id, metric, team string) bool {
+	if s.AssetID != 0 && s.AssetID != asset {
+		return false
+	}
+	if s.ConfigurationItemID != `` && s.ConfigurationItemID != id {
+		return false
+	}
+	if s.Team != `` && s.Team != team {
+		return false
+	}
+	if s.Metric != `` {
+		if ok, _ := path.Match(s.Metric, metric); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// storeSilence writes s into redis
+func storeSilence(r *redis.Client, s *Silence) error {
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return r.HSet(silenceKey, s.ID, string(buf)).Err()
+}
+
+// listSilences returns all silences stored in redis. Silences that
+// ended more than a day ago are removed.
+func listSilences(r *redis.Client) ([]Silence, error) {
+	mapdata, err := r.HGetAll(silenceKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	purge := time.Now().UTC().Add(-24 * time.Hour)
+	res := []Silence{}
+	for id, val := range mapdata {
+		s := Silence{}
+		if err := json.Unmarshal([]byte(val), &s); err != nil {
+			return nil, err
+		}
+		if s.EndsAt.Before(purge) {
+			r.HDel(silenceKey, id)
+			continue
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+// expireSilence ends the silence with the given id immediately. It
+// returns redis.Nil if there is no such silence.
+func expireSilence(r *redis.Client, id string) (*Silence, error) {
+	val, err := r.HGet(silenceKey, id).Result()
+	if err != nil {
+		return nil, err
+	}
+	s := &Silence{}
+	if err := json.Unmarshal([]byte(val), s); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if s.EndsAt.After(now) {
+		s.EndsAt = now
+	}
+	if s.StartsAt.After(s.EndsAt) {
+		s.StartsAt = s.EndsAt
+	}
+	return s, storeSilence(r, s)
+}
+
+// newID returns a random identifier in UUID format
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// silenced reports if alarms for the evaluation of metric from asset
+// against t are suppressed by an active silence
+func (c *Cyclone) silenced(asset int64, metric string, t Thresh) bool {
+	// silences are stored in redis
+	if c.redis == nil {
+		return false
+	}
+	now := time.Now().UTC()
+	if now.Sub(c.silenceLoad) > silenceRefresh {
+		s, err := listSilences(c.redis)
+		c.timeRedis(now)
+		if err != nil {
+			logrus.Errorf("Cyclone[%d], ERROR reading silences from redis: %s", c.Num, err)
+		} else {
+			c.silences = s
+			c.silenceLoad = now
+		}
+	}
+
+	for i := range c.silences {
+		if c.silences[i].Active(now) &&
+			c.silences[i].Matches(asset, t.ID, metric, t.MetaTeam) {
+			logrus.Debugf("Cyclone[%d], Alarm for %s suppressed by silence %s",
+				c.Num, t.ID, c.silences[i].ID)
+			return true
+		}
+	}
+	return false
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
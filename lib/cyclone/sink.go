@@ -0,0 +1,152 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// AlarmSink is the interface for destinations alarms are delivered to
+type AlarmSink interface {
+	// Name returns the configured name of the sink
+	Name() string
+	// Accepts reports if a passes the filters of the sink
+	Accepts(a AlarmEvent) bool
+	// Send delivers alarms to the sink
+	Send(alarms []AlarmEvent) error
+	// Close releases all resources held by the sink
+	Close() error
+}
+
+// CheckAlarming builds the alarm templates, sinks and routes from conf
+// like the handlers and the outbox do and returns all errors. The
+// sinks are closed again.
+func CheckAlarming(conf *Config) []error {
+	errs := []error{}
+	if _, err := newAlarmTemplates(conf); err != nil {
+		errs = append(errs, err)
+	}
+	sinks, err := newAlarmSinks(conf)
+	if err != nil {
+		return append(errs, err)
+	}
+	defer closeAlarmSinks(sinks)
+	if _, err = newAlarmRoutes(conf, sinks); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// newAlarmSinks returns all alarm sinks from conf. The sink for the
+// alarming destination URI is named default and is the only sink using
+// the global alarming authentication, signing and TLS settings. Sink
+// names must be unique.
+func newAlarmSinks(conf *Config) ([]AlarmSink, error) {
+	sinks := []AlarmSink{}
+	names := make(map[string]bool)
+	if conf.Cyclone.DestinationURI != `` {
+		s, err := newHTTPSink(
+			conf.Cyclone.DefaultSink(),
+			conf,
+			sinkFilter{},
+		)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+		names[s.Name()] = true
+	}
+
+	for _, s := range conf.Cyclone.AlarmSinks {
+		if names[s.Name] {
+			closeAlarmSinks(sinks)
+			return nil, fmt.Errorf("Duplicate alarm sink name %s", s.Name)
+		}
+		names[s.Name] = true
+		f, err := newSinkFilter(s.Name, s.Levels, s.Teams)
+		if err != nil {
+			closeAlarmSinks(sinks)
+			return nil, err
+		}
+
+		var sink AlarmSink
+		switch s.Type {
+		case `http`:
+			sink, err = newHTTPSink(s, conf, f)
+		case `kafka`:
+			sink, err = newKafkaSink(s.Name, s.Topic, conf, f)
+		case `file`:
+			sink, err = newFileSink(s.Name, s.Path, f)
+		case `syslog`:
+			sink, err = newSyslogSink(s.Name, f)
+		default:
+			err = fmt.Errorf("Unknown alarm sink type %s for sink %s",
+				s.Type, s.Name)
+		}
+		if err != nil {
+			closeAlarmSinks(sinks)
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// closeAlarmSinks closes all sinks
+func closeAlarmSinks(sinks []AlarmSink) {
+	for _, s := range sinks {
+		s.Close()
+	}
+}
+
+// sinkFilter restricts the alarms accepted by a sink to the configured
+// levels and teams. Empty filters accept everything.
+type sinkFilter struct {
+	levels map[int64]bool
+	teams  map[string]bool
+}
+
+// newSinkFilter returns the filter for levels and teams, name is used
+// in error messages
+func newSinkFilter(name string, levels, teams []string) (sinkFilter, error) {
+	f := sinkFilter{
+		levels: make(map[int64]bool),
+		teams:  make(map[string]bool),
+	}
+	for _, l := range levels {
+		lvl, err := strconv.ParseInt(l, 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("Invalid level %s for %s: %s",
+				l, name, err)
+		}
+		if lvl < 0 || lvl > 9 {
+			return f, fmt.Errorf("Invalid level %s for %s: must be 0 to 9",
+				l, name)
+		}
+		f.levels[lvl] = true
+	}
+	for _, t := range teams {
+		f.teams[t] = true
+	}
+	return f, nil
+}
+
+// Accepts reports if a passes the filter
+func (f sinkFilter) Accepts(a AlarmEvent) bool {
+	if len(f.levels) > 0 && !f.levels[a.Level] {
+		return false
+	}
+	if len(f.teams) > 0 && !f.teams[a.Team] {
+		return false
+	}
+	return true
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
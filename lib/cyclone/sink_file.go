@@ -0,0 +1,65 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// fileSink appends alarms as JSON lines to a file
+type fileSink struct {
+	sinkFilter
+	name string
+	lock sync.Mutex
+	fh   *os.File
+}
+
+// newFileSink returns an AlarmSink appending to the file at path
+func newFileSink(name, path string, f sinkFilter) (*fileSink, error) {
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{
+		sinkFilter: f,
+		name:       name,
+		fh:         fh,
+	}, nil
+}
+
+// Name implements AlarmSink
+func (s *fileSink) Name() string {
+	return s.name
+}
+
+// Send implements AlarmSink
+func (s *fileSink) Send(alarms []AlarmEvent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	enc := json.NewEncoder(s.fh)
+	for i := range alarms {
+		if err := enc.Encode(&alarms[i]); err != nil {
+			return err
+		}
+	}
+	return s.fh.Sync()
+}
+
+// Close implements AlarmSink
+func (s *fileSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.fh.Close()
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,133 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// httpSink delivers alarms to an alarm receiver via HTTP POST
+type httpSink struct {
+	sinkFilter
+	name   string
+	lock   sync.RWMutex
+	uri    string
+	auth   httpAuth
+	client *http.Client
+}
+
+// newHTTPSink returns an AlarmSink posting to the URI of sc.
+// Authentication, request signing and TLS are configured by sc, bearer
+// tokens and basic auth credentials are refused for URIs without TLS.
+func newHTTPSink(sc SinkConfig, conf *Config, f sinkFilter) (*httpSink, error) {
+	if sc.InsecureAuth() {
+		return nil, fmt.Errorf("Refusing to send credentials for sink %s without TLS to %s",
+			sc.Name, sc.URI)
+	}
+	tlsConfig, err := newTLSConfig(
+		sc.TLSCAFile,
+		sc.TLSCertFile,
+		sc.TLSKeyFile,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid TLS configuration for sink %s: %s",
+			sc.Name, err)
+	}
+	return &httpSink{
+		sinkFilter: f,
+		name:       sc.Name,
+		uri:        sc.URI,
+		auth: httpAuth{
+			token:    sc.AuthToken,
+			user:     sc.AuthUser,
+			password: sc.AuthPassword,
+			secret:   sc.HMACSecret,
+		},
+		client: newHTTPClient(tlsConfig, alarmTimeout(conf)),
+	}, nil
+}
+
+// alarmTimeout returns the configured timeout for alarm delivery
+func alarmTimeout(conf *Config) time.Duration {
+	if conf.Cyclone.AlarmTimeout == 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(conf.Cyclone.AlarmTimeout) * time.Millisecond
+}
+
+// setURI changes the URI alarms are posted to. Changes to a URI
+// without TLS are refused if the sink sends credentials.
+func (s *httpSink) setURI(uri string) error {
+	if insecureAuth(uri, s.auth.token, s.auth.user) {
+		return fmt.Errorf("Refusing to send credentials for sink %s without TLS to %s",
+			s.name, uri)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.uri = uri
+	return nil
+}
+
+// Name implements AlarmSink
+func (s *httpSink) Name() string {
+	return s.name
+}
+
+// Send implements AlarmSink. The receiver protocol accepts JSON arrays
+// of alarms.
+func (s *httpSink) Send(alarms []AlarmEvent) error {
+	b := new(bytes.Buffer)
+	if err := json.NewEncoder(b).Encode(alarms); err != nil {
+		return err
+	}
+	s.lock.RLock()
+	uri := s.uri
+	s.lock.RUnlock()
+	req, err := http.NewRequest(`POST`, uri, bytes.NewReader(b.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(`Content-Type`, `application/json; charset=utf-8`)
+	s.auth.apply(req, b.Bytes())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Sink[%s], Dispatched %d alarms, returncode was %d",
+		s.name, len(alarms), resp.StatusCode)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// read response body
+		bt, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return fmt.Errorf("ResponseMsg(%d): %s", resp.StatusCode, string(bt))
+	}
+	// ensure http.Response.Body is consumed and closed,
+	// otherwise it leaks filehandles
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return nil
+}
+
+// Close implements AlarmSink
+func (s *httpSink) Close() error {
+	return nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,85 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	"github.com/wvanbergen/kazoo-go"
+)
+
+// kafkaSink publishes alarms to a Kafka topic. The brokers are
+// discovered via the same Zookeeper ensemble the consumer uses.
+type kafkaSink struct {
+	sinkFilter
+	name     string
+	topic    string
+	producer sarama.SyncProducer
+}
+
+// newKafkaSink returns an AlarmSink producing to topic
+func newKafkaSink(name, topic string, conf *Config, f sinkFilter) (*kafkaSink, error) {
+	kz, err := kazoo.NewKazooFromConnectionString(
+		conf.Zookeeper.Connect, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer kz.Close()
+
+	brokers, err := kz.BrokerList()
+	if err != nil {
+		return nil, err
+	}
+
+	config := sarama.NewConfig()
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+
+	producer, err := sarama.NewSyncProducer(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaSink{
+		sinkFilter: f,
+		name:       name,
+		topic:      topic,
+		producer:   producer,
+	}, nil
+}
+
+// Name implements AlarmSink
+func (s *kafkaSink) Name() string {
+	return s.name
+}
+
+// Send implements AlarmSink. Every alarm is published as its own
+// message keyed by its EventID.
+func (s *kafkaSink) Send(alarms []AlarmEvent) error {
+	msgs := make([]*sarama.ProducerMessage, 0, len(alarms))
+	for _, a := range alarms {
+		buf, err := json.Marshal(&a)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, &sarama.ProducerMessage{
+			Topic: s.topic,
+			Key:   sarama.StringEncoder(a.EventID),
+			Value: sarama.ByteEncoder(buf),
+		})
+	}
+	return s.producer.SendMessages(msgs)
+}
+
+// Close implements AlarmSink
+func (s *kafkaSink) Close() error {
+	return s.producer.Close()
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,71 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"fmt"
+	"log/syslog"
+)
+
+// syslogSink writes alarms to the local syslog daemon
+type syslogSink struct {
+	sinkFilter
+	name   string
+	writer *syslog.Writer
+}
+
+// newSyslogSink returns an AlarmSink logging to the local syslog
+func newSyslogSink(name string, f sinkFilter) (*syslogSink, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, `cyclone`)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{
+		sinkFilter: f,
+		name:       name,
+		writer:     w,
+	}, nil
+}
+
+// Name implements AlarmSink
+func (s *syslogSink) Name() string {
+	return s.name
+}
+
+// Send implements AlarmSink. The syslog severity is derived from the
+// alarm level.
+func (s *syslogSink) Send(alarms []AlarmEvent) error {
+	for _, a := range alarms {
+		line := fmt.Sprintf("%s: %s [level %d, event %s, team %s] %s",
+			a.Targethost, a.Check, a.Level, a.EventID, a.Team, a.Message)
+
+		var err error
+		switch {
+		case a.Level == 0:
+			err = s.writer.Info(line)
+		case a.Level < 5:
+			err = s.writer.Warning(line)
+		case a.Level < 8:
+			err = s.writer.Err(line)
+		default:
+			err = s.writer.Crit(line)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close implements AlarmSink
+func (s *syslogSink) Close() error {
+	return s.writer.Close()
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,158 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/mjolnir42/cyclone/lib/cyclone/cpu"
+	"github.com/mjolnir42/cyclone/lib/cyclone/disk"
+	"github.com/mjolnir42/cyclone/lib/cyclone/mem"
+	"github.com/mjolnir42/legacy"
+)
+
+// BuildInfo describes the running cyclone build
+type BuildInfo struct {
+	Githash   string `json:"githash"`
+	Shorthash string `json:"shorthash"`
+	Builddate string `json:"builddate"`
+	Buildtime string `json:"buildtime"`
+}
+
+// HandlerStatus is the runtime status of a handler
+type HandlerStatus struct {
+	Num           int       `json:"num"`
+	QueueDepth    int       `json:"queue_depth"`
+	QueueCapacity int       `json:"queue_capacity"`
+	LastActivity  time.Time `json:"last_activity"`
+}
+
+// AssetState is the derived metric state kept for an asset
+type AssetState struct {
+	AssetID    int64                `json:"asset_id"`
+	Handler    int                  `json:"handler"`
+	LastUpdate time.Time            `json:"last_update"`
+	CPU        *cpu.CPU             `json:"cpu,omitempty"`
+	CTX        *cpu.CTX             `json:"ctx,omitempty"`
+	Mem        *mem.Mem             `json:"mem,omitempty"`
+	Disk       map[string]disk.Disk `json:"disk,omitempty"`
+}
+
+// FiringAlarm is the most recent alarm with a level above zero for a
+// configuration item
+type FiringAlarm struct {
+	Handler int        `json:"handler"`
+	AssetID int64      `json:"asset_id"`
+	Metric  string     `json:"metric"`
+	Alarm   AlarmEvent `json:"alarm"`
+}
+
+// recordLevel updates the alarm level of the configuration item of a,
+// which was raised for metric m. Alarm levels are kept per asset and
+// are evicted with the derived metric state of the asset.
+func (c *Cyclone) recordLevel(a AlarmEvent, m *legacy.MetricSplit) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	c.touch(m.AssetID)
+	if c.lastLevel[m.AssetID] == nil {
+		c.lastLevel[m.AssetID] = make(map[string]int64)
+	}
+	c.lastLevel[m.AssetID][a.EventID] = a.Level
+	if a.Level == 0 {
+		delete(c.firing[m.AssetID], a.EventID)
+		if len(c.firing[m.AssetID]) == 0 {
+			delete(c.firing, m.AssetID)
+		}
+		return
+	}
+	if c.firing[m.AssetID] == nil {
+		c.firing[m.AssetID] = make(map[string]FiringAlarm)
+	}
+	c.firing[m.AssetID][a.EventID] = FiringAlarm{
+		Handler: c.Num,
+		AssetID: m.AssetID,
+		Metric:  m.Path,
+		Alarm:   a,
+	}
+}
+
+// status returns the runtime status of the handler
+func (c *Cyclone) status() HandlerStatus {
+	s := HandlerStatus{
+		Num:           c.Num,
+		QueueDepth:    len(c.Input),
+		QueueCapacity: cap(c.Input),
+	}
+	if ts := atomic.LoadInt64(&c.lastActivity); ts != 0 {
+		s.LastActivity = time.Unix(0, ts).UTC()
+	}
+	return s
+}
+
+// assetState returns the derived metric state for asset id or nil if
+// the handler has no state for it
+func (c *Cyclone) assetState(id int64) *AssetState {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+
+	seen, ok := c.assetSeen[id]
+	if !ok {
+		return nil
+	}
+	s := &AssetState{
+		AssetID:    id,
+		Handler:    c.Num,
+		LastUpdate: seen,
+	}
+	if v, ok := c.CPUData[id]; ok {
+		s.CPU = &v
+	}
+	if v, ok := c.CTXData[id]; ok {
+		s.CTX = &v
+	}
+	if v, ok := c.MemData[id]; ok {
+		s.Mem = &v
+	}
+	if len(c.DskData[id]) > 0 {
+		s.Disk = make(map[string]disk.Disk, len(c.DskData[id]))
+		for mpt, d := range c.DskData[id] {
+			s.Disk[mpt] = d
+		}
+	}
+	return s
+}
+
+// firingAlarms returns the alarms currently firing on the handler
+func (c *Cyclone) firingAlarms() []FiringAlarm {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+
+	res := []FiringAlarm{}
+	for id := range c.firing {
+		for _, a := range c.firing[id] {
+			res = append(res, a)
+		}
+	}
+	return res
+}
+
+// cyclones returns all registered handlers, sorted by number
+func cyclones() []*Cyclone {
+	res := []*Cyclone{}
+	for i := 0; i < len(Handlers); i++ {
+		if c, ok := Handlers[i].(*Cyclone); ok {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
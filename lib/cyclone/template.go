@@ -0,0 +1,142 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cyclone // import "github.com/mjolnir42/cyclone/lib/cyclone"
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// defaultMessageTemplate is the alarm message used if no template
+	// is configured
+	defaultMessageTemplate = `{{if eq .Level 0}}Ok.{{else}}Metric {{.Metric}} has broken threshold. Value {{.Value}} {{.Predicate}} {{.Threshold}}{{end}}`
+	// defaultCheckTemplate is the alarm check used if no template is
+	// configured
+	defaultCheckTemplate = `cyclone({{.Metric}})`
+)
+
+// fallbackTemplates are used if rendering the configured templates
+// fails
+var fallbackTemplates = &alarmTemplates{
+	global: alarmTemplate{
+		message: template.Must(template.New(`message`).Parse(defaultMessageTemplate)),
+		check:   template.Must(template.New(`check`).Parse(defaultCheckTemplate)),
+	},
+}
+
+// AlarmContext is the data available to alarm message templates
+type AlarmContext struct {
+	Metric              string
+	Value               string
+	Unit                string
+	Predicate           string
+	Level               int64
+	PreviousLevel       int64
+	Threshold           int64
+	Thresholds          map[string]int64
+	AssetID             int64
+	Tags                []string
+	Timestamp           time.Time
+	ConfigurationItemID string
+	Oncall              string
+	Monitoring          string
+	Team                string
+	Source              string
+	Targethost          string
+}
+
+// alarmTemplate is the pair of message and check templates selected by
+// team and metric prefix
+type alarmTemplate struct {
+	team         string
+	metricPrefix string
+	message      *template.Template
+	check        *template.Template
+}
+
+// alarmTemplates holds all configured alarm templates
+type alarmTemplates struct {
+	global   alarmTemplate
+	specific []alarmTemplate
+}
+
+// newAlarmTemplates parses all alarm templates from conf
+func newAlarmTemplates(conf *Config) (*alarmTemplates, error) {
+	t := &alarmTemplates{}
+	var err error
+
+	msg := conf.Cyclone.AlarmMessageTemplate
+	if msg == `` {
+		msg = defaultMessageTemplate
+	}
+	chk := conf.Cyclone.AlarmCheckTemplate
+	if chk == `` {
+		chk = defaultCheckTemplate
+	}
+	if t.global.message, err = template.New(`message`).Parse(msg); err != nil {
+		return nil, fmt.Errorf("Invalid alarm message template: %s", err)
+	}
+	if t.global.check, err = template.New(`check`).Parse(chk); err != nil {
+		return nil, fmt.Errorf("Invalid alarm check template: %s", err)
+	}
+
+	for _, c := range conf.Cyclone.AlarmTemplates {
+		at := alarmTemplate{
+			team:         c.Team,
+			metricPrefix: c.MetricPrefix,
+			message:      t.global.message,
+			check:        t.global.check,
+		}
+		name := fmt.Sprintf("%s:%s", c.Team, c.MetricPrefix)
+		if c.Message != `` {
+			if at.message, err = template.New(name).Parse(c.Message); err != nil {
+				return nil, fmt.Errorf("Invalid alarm message template for %s: %s", name, err)
+			}
+		}
+		if c.Check != `` {
+			if at.check, err = template.New(name).Parse(c.Check); err != nil {
+				return nil, fmt.Errorf("Invalid alarm check template for %s: %s", name, err)
+			}
+		}
+		t.specific = append(t.specific, at)
+	}
+	return t, nil
+}
+
+// render returns the alarm message and check for ctx, using the first
+// template matching the team and metric prefix of ctx
+func (t *alarmTemplates) render(ctx *AlarmContext) (string, string, error) {
+	at := t.global
+	for _, s := range t.specific {
+		if s.team != `` && s.team != ctx.Team {
+			continue
+		}
+		if !strings.HasPrefix(ctx.Metric, s.metricPrefix) {
+			continue
+		}
+		at = s
+		break
+	}
+
+	msg := new(bytes.Buffer)
+	if err := at.message.Execute(msg, ctx); err != nil {
+		return ``, ``, err
+	}
+	chk := new(bytes.Buffer)
+	if err := at.check.Execute(chk, ctx); err != nil {
+		return ``, ``, err
+	}
+	return msg.String(), chk.String(), nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix